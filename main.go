@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/kairos-io/kairos-init/pkg/features"
 	. "github.com/kairos-io/kairos-init/pkg/log"
@@ -8,19 +9,43 @@ import (
 	"github.com/kairos-io/kairos-init/pkg/validator"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/spf13/cobra"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"text/tabwriter"
 )
 import "github.com/spf13/viper"
 
 func main() {
 	var err error
+	// Set when the command writes a machine-readable output, so nothing else can go to stdout
+	machineReadable := false
 
-	Log.Info("Initializing system as a Kairos system.")
 	c := cobra.Command{
 		Use:   "kairos-init",
 		Short: "Initialize the system as a Kairos system",
 		Args:  cobra.NoArgs,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// The console logs go to stdout, so move them out of the way of a json or junit output
+			if output := cmd.Flags().Lookup("output"); output != nil && output.Value.String() != "text" {
+				ToStderr()
+				machineReadable = true
+			}
+			// Override logger if the level has changed
+			Log.SetLevel(viper.GetString("loglevel"))
+			if config := viper.GetString("config"); config != "" {
+				Log.Logger.Debug().Str("config", config).Msg("Reading config file")
+				viper.SetConfigFile(config)
+				if err := viper.ReadInConfig(); err != nil {
+					return fmt.Errorf("reading config file %s: %w", config, err)
+				}
+				// Config could have changed the log level
+				Log.SetLevel(viper.GetString("loglevel"))
+			}
+			return nil
+		},
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if len(viper.GetStringSlice("features")) == 0 {
 				return fmt.Errorf("no features specified")
@@ -36,25 +61,57 @@ func main() {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Override logger if the level has changed
-			Log.SetLevel(viper.GetString("loglevel"))
+			cmd.SilenceUsage = true
+			Log.Info("Initializing system as a Kairos system.")
 
-			s := system.DetectSystem(Log)
+			s, err := newSystem()
+			if err != nil {
+				return err
+			}
+			s.StrictPackages = viper.GetBool("strict-packages")
+			s.Force = viper.GetBool("force")
+			s.KernelVersion = viper.GetString("kernel-version")
+			s.FrameworkImage = viper.GetString("framework-image")
+			s.Release = values.Release{
+				Variant:     viper.GetString("variant"),
+				Model:       viper.GetString("model"),
+				Version:     viper.GetString("kairos-version"),
+				Registry:    viper.GetString("registry"),
+				K8sProvider: viper.GetString("k8s-provider"),
+				K8sVersion:  viper.GetString("k8s-version"),
+			}
+			if err = s.Release.Validate(); err != nil {
+				return err
+			}
+			s.K8sSource = viper.GetString("k8s-source")
 
-			if len(viper.GetStringSlice("features")) == 1 && viper.GetStringSlice("features")[0] == "all" {
+			names := viper.GetStringSlice("features")
+			// Same as OrderFeatures, all means every feature no matter what else was requested
+			if slices.Contains(names, "all") {
 				Log.Logger.Info().Msg("Adding all features to queue")
-				for _, f := range features.GetOrderedFeatures() {
-					s.AddFeature(f)
-				}
-			} else {
-				for _, f := range viper.GetStringSlice("features") {
-					Log.Logger.Info().Str("feature", f).Msg("Adding feature to queue")
-					s.AddFeature(features.GetFeature(f))
-				}
+				names = features.FeatSupported()
+			}
+			// Features are sorted by their dependencies, which are added if not requested
+			if err = s.ResolveFeatures(features.Features, names, Log); err != nil {
+				return err
+			}
+
+			if viper.GetBool("dry-run") {
+				Log.Logger.Info().Msg("Running in dry-run mode, no changes will be made to the system")
+				s.Plan = &values.Plan{}
 			}
 
 			Log.Logger.Debug().Interface("system", s).Msg("Detected system")
 
+			if s.Chrooted() && !s.DryRun() {
+				Log.Logger.Info().Str("root", s.Root).Msg("Running against an alternate root")
+				cleanup, err := system.PrepareChroot(s, Log)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+			}
+
 			err = s.ApplyFeatures(Log)
 			if err != nil {
 				Log.Logger.Err(err).Msg("Error applying features")
@@ -65,7 +122,11 @@ func main() {
 				Log.Logger.Err(err).Msg("Error applying workarounds")
 				return err
 			}
-			return validator.ValidateFeatures(s.Features)
+			if s.DryRun() {
+				fmt.Printf("Dry-run plan for %s (%s %s %s)\n", s.Name, s.Distro, s.Version, s.Arch)
+				return s.Plan.Write(os.Stdout)
+			}
+			return validator.ValidateFeatures(s, s.Features, os.Stdout, validator.TextOutput)
 		},
 	}
 
@@ -75,12 +136,51 @@ func main() {
 		Log.Logger.Err(err).Msg("Error binding environment variable")
 		return
 	}
-	c.Flags().BoolP("dry-run", "d", false, "Dry run")
-	err = viper.BindEnv("features", "KAIROS_INIT_DRY_RUN")
+	c.Flags().BoolP("dry-run", "d", false, "Dry run. Print the packages, commands and files that would be changed without touching the system")
+	err = viper.BindEnv("dry-run", "KAIROS_INIT_DRY_RUN")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+	c.Flags().Bool("force", false, fmt.Sprintf("Install all the features again, even if they are installed or completed on a previous run as recorded in %s", values.StateFile))
+	err = viper.BindEnv("force", "KAIROS_INIT_FORCE")
 	if err != nil {
 		Log.Logger.Err(err).Msg("Error binding environment variable")
 		return
 	}
+	c.Flags().String("kernel-version", "", "Kernel version to use, as named under /lib/modules. Defaults to the newest installed kernel")
+	err = viper.BindEnv("kernel-version", "KAIROS_INIT_KERNEL_VERSION")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+	c.Flags().Bool("strict-packages", false, "Fail if any package category has no packages defined for the detected system, or a package to remove from config is not found")
+	err = viper.BindEnv("strict-packages", "KAIROS_INIT_STRICT_PACKAGES")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+	c.Flags().String("framework-image", values.DefaultFrameworkImage, "Framework to install. An image reference by tag or digest, or a local OCI layout directory, docker save tarball or rootfs tarball. The resolved digest is recorded in /etc/kairos-release")
+	err = viper.BindEnv("framework-image", "KAIROS_INIT_FRAMEWORK_IMAGE")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+	// Inputs for the release file
+	c.Flags().String("variant", values.DefaultVariant, fmt.Sprintf("Variant of the image. Known variants: %v", []string{values.CoreVariant, values.StandardVariant}))
+	c.Flags().String("model", values.DefaultModel, "Model of the image, like generic or rpi4")
+	c.Flags().String("kairos-version", "", fmt.Sprintf("Kairos version of the image. Defaults to %s", values.DefaultVersion))
+	c.Flags().String("registry", values.DefaultRegistry, "Registry and org where the image is published")
+	c.Flags().String("k8s-provider", "", fmt.Sprintf("K8s provider of the image, for the standard variant. Known providers: %v", values.K8sProviders()))
+	c.Flags().String("k8s-version", "", "Version of the k8s provider")
+	c.Flags().String("k8s-source", "", "Where to get the k8s provider from. A local binary, an image reference or a local OCI layout or tarball. Defaults to the provider image for the k8s version")
+	for _, input := range []string{"variant", "model", "kairos-version", "registry", "k8s-provider", "k8s-version", "k8s-source"} {
+		err = viper.BindEnv(input, "KAIROS_INIT_"+strings.ToUpper(strings.ReplaceAll(input, "-", "_")))
+		if err != nil {
+			Log.Logger.Err(err).Msg("Error binding environment variable")
+			return
+		}
+	}
 	// Global flag
 	c.PersistentFlags().StringP("loglevel", "l", "info", "Log level")
 	err = viper.BindEnv("loglevel", "KAIROS_INIT_LOGLEVEL")
@@ -89,6 +189,41 @@ func main() {
 		return
 	}
 
+	c.PersistentFlags().StringP("config", "c", "", "Config file with extra options, like packages to add or remove from the package maps")
+	err = viper.BindEnv("config", "KAIROS_INIT_CONFIG")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+
+	c.PersistentFlags().StringP("root", "r", "/", "Root directory of the system to convert. Commands are run chrooted into it")
+	err = viper.BindEnv("root", "KAIROS_INIT_ROOT")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+
+	c.PersistentFlags().String("boot-mode", values.GrubBoot.String(), fmt.Sprintf("Boot mode of the system, selects the packages and features to install. Known boot modes: %v", values.BootModes()))
+	err = viper.BindEnv("boot-mode", "KAIROS_INIT_BOOT_MODE")
+	if err != nil {
+		Log.Logger.Err(err).Msg("Error binding environment variable")
+		return
+	}
+
+	// Overrides for the detected system values
+	c.PersistentFlags().String("distro", "", fmt.Sprintf("Override the detected distro. Known distros: %v", values.Distros()))
+	c.PersistentFlags().String("family", "", fmt.Sprintf("Override the detected family. Known families: %v", values.Families()))
+	c.PersistentFlags().String("version", "", "Override the detected distro version")
+	c.PersistentFlags().String("arch", "", fmt.Sprintf("Override the detected arch. Known archs: %v", values.Architectures()))
+	c.PersistentFlags().String("installer", "", fmt.Sprintf("Override the installer for the distro. Known installers: %v", features.Installers()))
+	for _, override := range []string{"distro", "family", "version", "arch", "installer"} {
+		err = viper.BindEnv(override, "KAIROS_INIT_"+strings.ToUpper(override))
+		if err != nil {
+			Log.Logger.Err(err).Msg("Error binding environment variable")
+			return
+		}
+	}
+
 	// Define the subcommand
 	subCmd := &cobra.Command{
 		Use:                   "show FEATURE",
@@ -106,9 +241,12 @@ func main() {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			s := system.DetectSystem(Log)
+			s, err := newSystem()
+			if err != nil {
+				return err
+			}
 			Log.Logger.Info().Str("feature", args[0]).Msg("Getting feature")
-			f := s.GetFeature(args[0], Log)
+			f := features.GetFeature(args[0])
 			if f == nil {
 				Log.Logger.Err(fmt.Errorf("feature %s not found", args[0])).Msg("Error")
 				return fmt.Errorf("feature %s not found", args[0])
@@ -128,22 +266,30 @@ func main() {
 
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
-			var f []values.Feature
-			if len(viper.GetStringSlice("features")) == 1 && viper.GetStringSlice("features")[0] == "all" {
-				Log.Logger.Info().Msg("Adding all features to queue")
-				for _, feat := range features.GetOrderedFeatures() {
-					f = append(f, feat)
-				}
-			} else {
-				for _, feat := range viper.GetStringSlice("features") {
-					Log.Logger.Info().Str("feature", feat).Msg("Adding feature to queue")
-					f = append(f, features.GetFeature(feat))
-				}
+			s, err := newSystem()
+			if err != nil {
+				return err
+			}
+			// The root command binds the features key to its own flag, so read ours directly and fall back to the
+			// env var or config file if it was not given
+			names, _ := cmd.Flags().GetStringArray("features")
+			if !cmd.Flags().Changed("features") {
+				names = viper.GetStringSlice("features")
+			}
+			if len(names) == 0 {
+				names = []string{"all"}
+			}
+			// Validate in the same order they are installed
+			f, err := features.OrderFeatures(names, Log)
+			if err != nil {
+				return err
 			}
-			return validator.ValidateFeatures(f)
+			output, _ := cmd.Flags().GetString("output")
+			return validator.ValidateFeatures(s, f, os.Stdout, output)
 		},
 	}
-	validatorCmd.Flags().StringArrayP("features", "f", []string{}, fmt.Sprintf("Features to install. Available features: %s", strings.Join(features.FeatSupported(), ", ")))
+	validatorCmd.Flags().StringP("output", "o", validator.TextOutput, fmt.Sprintf("Output format: %s", strings.Join(validator.OutputFormats(), ", ")))
+	validatorCmd.Flags().StringArrayP("features", "f", []string{}, fmt.Sprintf("Features to validate, all of them if not set. Available features: %s", strings.Join(features.FeatSupported(), ", ")))
 	err = viper.BindEnv("features", "KAIROS_INIT_FEATURES")
 	if err != nil {
 		Log.Logger.Err(err).Msg("Error binding environment variable")
@@ -151,8 +297,98 @@ func main() {
 	}
 	c.AddCommand(validatorCmd)
 
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove features from the system, undoing what they installed",
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			feats, _ := cmd.Flags().GetStringArray("features")
+			if len(feats) == 0 {
+				return fmt.Errorf("no features specified")
+			}
+			for _, feature := range feats {
+				if feature != "all" && !features.FeatureSupported(feature) {
+					return fmt.Errorf("feature %s not supported. Available features: %s", feature, strings.Join(features.FeatSupported(), ", "))
+				}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			s, err := newSystem()
+			if err != nil {
+				return err
+			}
+			feats, _ := cmd.Flags().GetStringArray("features")
+			// Keep the install order, so they can be removed in reverse
+			s.Features, err = features.OrderFeatures(feats, Log)
+			if err != nil {
+				return err
+			}
+			if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+				s.Plan = &values.Plan{}
+			}
+			if s.Chrooted() && !s.DryRun() {
+				cleanup, err := system.PrepareChroot(s, Log)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+			}
+			if err = s.RemoveFeatures(Log); err != nil {
+				Log.Logger.Err(err).Msg("Error removing features")
+				return err
+			}
+			if s.DryRun() {
+				fmt.Printf("Dry-run removal plan for %s (%s %s %s)\n", s.Name, s.Distro, s.Version, s.Arch)
+				return s.Plan.Write(os.Stdout)
+			}
+			return nil
+		},
+	}
+	removeCmd.Flags().StringArrayP("features", "f", []string{}, fmt.Sprintf("Features to remove. Available features: %s", strings.Join(features.FeatSupported(), ", ")))
+	removeCmd.Flags().BoolP("dry-run", "d", false, "Dry run. Print the packages, commands and files that would be removed without touching the system")
+	c.AddCommand(removeCmd)
+
+	packagesCmd := &cobra.Command{
+		Use:   "packages",
+		Short: "Show the packages that would be installed for the system",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			check, _ := cmd.Flags().GetBool("check")
+			if check {
+				// Not tied to the detected system, only to the boot mode
+				mode := values.System{BootMode: values.BootMode(viper.GetString("boot-mode"))}.GetBootMode()
+				if !slices.Contains(values.BootModes(), mode) {
+					return fmt.Errorf("unknown boot mode %s. Known boot modes: %v", mode, values.BootModes())
+				}
+				return printPackageCoverage(os.Stdout, mode)
+			}
+			s, err := newSystem()
+			if err != nil {
+				return err
+			}
+			resolved, err := features.ResolvePackages(s, Log)
+			if err != nil {
+				return err
+			}
+			output, _ := cmd.Flags().GetString("output")
+			return printPackages(os.Stdout, s, resolved, output)
+		},
+	}
+	packagesCmd.Flags().Bool("check", false, "List which package categories have packages defined for each distro and arch")
+	packagesCmd.Flags().StringP("output", "o", "text", "Output format: text or json")
+	c.AddCommand(packagesCmd)
+
 	// Bind persistent flag especifically
 	_ = viper.BindPFlag("loglevel", c.PersistentFlags().Lookup("loglevel"))
+	_ = viper.BindPFlag("root", c.PersistentFlags().Lookup("root"))
+	_ = viper.BindPFlag("config", c.PersistentFlags().Lookup("config"))
+	_ = viper.BindPFlag("boot-mode", c.PersistentFlags().Lookup("boot-mode"))
+	for _, override := range []string{"distro", "family", "version", "arch", "installer"} {
+		_ = viper.BindPFlag(override, c.PersistentFlags().Lookup(override))
+	}
 	err = viper.BindPFlags(c.Flags())
 
 	if err != nil {
@@ -163,5 +399,122 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
-	Log.Logger.Info().Msg("Done")
+	if !machineReadable {
+		Log.Logger.Info().Msg("Done")
+	}
+}
+
+// newSystem detects the system under the configured root and applies the user overrides to it
+func newSystem() (values.System, error) {
+	root, err := getRoot()
+	if err != nil {
+		return values.System{}, err
+	}
+	s := system.DetectSystem(root, Log)
+	o := system.Overrides{
+		Distro:    viper.GetString("distro"),
+		Family:    viper.GetString("family"),
+		Version:   viper.GetString("version"),
+		Arch:      viper.GetString("arch"),
+		Installer: viper.GetString("installer"),
+	}
+	if err = o.Apply(&s, Log); err != nil {
+		return s, err
+	}
+	s.BootMode = values.BootMode(viper.GetString("boot-mode"))
+	if err = s.ValidateBootMode(); err != nil {
+		return s, err
+	}
+	if err = viper.UnmarshalKey("packages", &s.PackageOverrides); err != nil {
+		return s, fmt.Errorf("reading packages from config: %w", err)
+	}
+	if err = s.PackageOverrides.Validate(); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// getRoot returns the absolute path to the root of the system to work on
+func getRoot() (string, error) {
+	root, err := filepath.Abs(viper.GetString("root"))
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("root %s is not a directory", root)
+	}
+	return root, nil
+}
+
+// printPackageCoverage prints a table with the package categories that have packages for each known distro and arch.
+// Only the categories that apply to the boot mode are shown
+func printPackageCoverage(out io.Writer, mode values.BootMode) error {
+	var categories []values.PackageCategory
+	for _, category := range values.PackageCategories() {
+		if category.AppliesTo(mode) {
+			categories = append(categories, category)
+		}
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	header := []string{"DISTRO", "ARCH"}
+	for _, category := range categories {
+		header = append(header, strings.ToUpper(category.String()))
+	}
+	_, _ = fmt.Fprintf(out, "Package coverage for %s boot\n", mode)
+	_, _ = fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, distro := range values.Distros() {
+		for _, arch := range values.Architectures() {
+			missing := map[values.PackageCategory]bool{}
+			for _, category := range values.MissingPackageCategories(distro, arch, "", mode) {
+				missing[category] = true
+			}
+			row := []string{distro.String(), arch.String()}
+			for _, category := range categories {
+				status := "ok"
+				if missing[category] {
+					status = "missing"
+				}
+				row = append(row, status)
+			}
+			_, _ = fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+	}
+	return w.Flush()
+}
+
+// printPackages prints the resolved packages grouped by category in the given format
+func printPackages(out io.Writer, s values.System, resolved []features.ResolvedPackage, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]interface{}{
+			"distro":   s.Distro,
+			"version":  s.Version,
+			"arch":     s.Arch,
+			"packages": resolved,
+		})
+	case "text":
+		_, _ = fmt.Fprintf(out, "Packages for %s %s %s\n", s.Distro, s.Version, s.Arch)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		category := ""
+		for _, p := range resolved {
+			if p.Category != category {
+				category = p.Category
+				_, _ = fmt.Fprintf(w, "%s:\n", category)
+			}
+			source := ""
+			if p.FromConfig {
+				source = "(config)"
+			}
+			_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", p.Name, p.Constraint, source)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
 }
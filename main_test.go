@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so the commands can be run as a user would
+const runMainEnv = "KAIROS_INIT_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs kairos-init with the args and returns its stdout. The exit code is ignored, as commands like
+// validate fail when checks fail but still write their output
+func runCommand(t *testing.T, args ...string) []byte {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("running %v: %v", args, err)
+	}
+	t.Logf("stderr of %v:\n%s", args, stderr.String())
+	return stdout.Bytes()
+}
+
+// testRoot returns a root with a release file, so the release checks have something to validate
+func testRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	release := "KAIROS_ID=\"kairos\"\nKAIROS_VERSION=\"v3.2.3\"\nKAIROS_ARCH=\"x86\"\n"
+	if err := os.WriteFile(filepath.Join(root, "etc", "kairos-release"), []byte(release), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestValidateOutput(t *testing.T) {
+	root := testRoot(t)
+	tests := []struct {
+		format string
+		parse  func([]byte) (int, error)
+	}{
+		{"json", func(out []byte) (int, error) {
+			var report struct {
+				Results []struct {
+					Check string `json:"check"`
+				} `json:"results"`
+			}
+			err := json.Unmarshal(out, &report)
+			return len(report.Results), err
+		}},
+		{"junit", func(out []byte) (int, error) {
+			var report struct {
+				Suites []struct {
+					TestCases []struct {
+						Name string `xml:"name,attr"`
+					} `xml:"testcase"`
+				} `xml:"testsuite"`
+			}
+			// The decoder ignores anything around the root element, so check there is nothing there
+			if !bytes.HasPrefix(out, []byte(xml.Header)) || !bytes.HasSuffix(bytes.TrimSpace(out), []byte("</testsuites>")) {
+				return 0, errors.New("extra output around the report")
+			}
+			err := xml.Unmarshal(out, &report)
+			cases := 0
+			for _, suite := range report.Suites {
+				cases += len(suite.TestCases)
+			}
+			return cases, err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			// Debug level so every log line would end in the output if it went to stdout
+			out := runCommand(t, "validate", "--root", root, "-f", "release", "-o", tt.format, "--loglevel", "debug")
+			cases, err := tt.parse(out)
+			if err != nil {
+				t.Fatalf("output is not valid %s: %v\n%s", tt.format, err, out)
+			}
+			if cases == 0 {
+				t.Errorf("no checks in the output:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestPackagesOutput(t *testing.T) {
+	// The overrides log a warning, that must not end in the output
+	out := runCommand(t, "packages", "--root", t.TempDir(), "--distro", "ubuntu", "--version", "24.04", "--arch", "amd64",
+		"--installer", "apt-get", "-o", "json", "--loglevel", "debug")
+	var list struct {
+		Distro   string `json:"distro"`
+		Packages []struct {
+			Name     string `json:"name"`
+			Category string `json:"category"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		t.Fatalf("output is not valid json: %v\n%s", err, out)
+	}
+	if list.Distro != "ubuntu" || len(list.Packages) == 0 {
+		t.Errorf("unexpected package list for ubuntu:\n%s", out)
+	}
+}
@@ -0,0 +1,91 @@
+package features
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Helpers shared by the feature checks. Checks only read the system, so they behave the same on dry-run
+
+// binaryDirs are the usual binary dirs, searched under the root when the system is not the running one
+var binaryDirs = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// lookPath searches for the binary in the system PATH. If the system lives on a different root, we cant rely
+// on the host PATH so we search the usual binary dirs under the root instead
+func lookPath(s values.System, bin string) (string, error) {
+	if !s.Chrooted() {
+		return exec.LookPath(bin)
+	}
+	for _, dir := range binaryDirs {
+		path := s.RootPath(filepath.Join(dir, bin))
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: bin, Err: exec.ErrNotFound}
+}
+
+// checkBinaries checks that the expected binaries are there.
+// Binaries can be given as "a|b" for the same binary with different names in different OSes, any of them is enough
+func checkBinaries(s values.System, binaries []string) error {
+	var errs []error
+	for _, bin := range binaries {
+		found := false
+		for _, b := range strings.Split(bin, "|") {
+			if _, err := lookPath(s, b); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, &exec.Error{Name: strings.ReplaceAll(bin, "|", " or "), Err: exec.ErrNotFound})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkLink checks that the path is a symlink that resolves to an existing file.
+// Links are relative so they resolve the same inside and outside the root
+func checkLink(s values.System, path string) error {
+	info, err := os.Lstat(s.RootPath(path))
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s is not a link", path)
+	}
+	if _, err = os.Stat(s.RootPath(path)); err != nil {
+		target, _ := os.Readlink(s.RootPath(path))
+		return fmt.Errorf("%s points to %s, which does not exist", path, target)
+	}
+	return nil
+}
+
+// checkSystemdVersion checks that systemd is new enough for trusted boot
+func checkSystemdVersion(s values.System, l sdkTypes.KairosLogger) error {
+	out, err := CommandOutput(s, "systemctl", []string{"--version"}, l)
+	if err != nil {
+		return fmt.Errorf("getting systemd version: %w", err)
+	}
+	// First line is like "systemd 255 (255.4-1ubuntu8)"
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != "systemd" {
+		return fmt.Errorf("cannot parse systemd version from %q", out)
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("cannot parse systemd version from %q: %w", out, err)
+	}
+	if version < values.MinSystemdVersionTrusted {
+		return fmt.Errorf("systemd version %d is too old for trusted boot, needs at least %d", version, values.MinSystemdVersionTrusted)
+	}
+	l.Logger.Debug().Int("version", version).Msg("Found systemd")
+	return nil
+}
@@ -1,67 +1,88 @@
 package features
 
 import (
+	"fmt"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // Cleanup represents the Cleanup feature.
 // This feature is used to cleanup the system after the installation.
 // Removes unnecessary files and directories. Cleans packages caches, etc...
-type Cleanup struct {
-	Order int
-}
+type Cleanup struct{}
 
 func (c Cleanup) Install(system values.System, logger sdkTypes.KairosLogger) error {
-	// Empty machine-id
-	f, err := os.OpenFile("/etc/machine-id", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	// Cleanup cannot be undone, but we still record what was removed
+	m, err := LoadManifest(system, c.Name())
+	if err != nil {
+		return err
+	}
+	// Empty machine-id. It is truncated and not removed, as systemd expects it to exist, so it is not recorded
+	err = createFile(system, system.RootPath("/etc/machine-id"), logger)
 	if err != nil {
 		return err
 	}
-	_ = f.Close()
 	// remove specific files
 	for _, f := range values.FilesToRemove() {
-		err = os.RemoveAll(f)
+		err = removePath(system, system.RootPath(f), logger)
 		if err != nil {
 			logger.Logger.Error().Err(err).Str("file", f).Msg("Error removing file.")
 			return err
 		}
+		m.AddRemoved(f)
+	}
+	// The state is only useful while building, it should not end in the final image
+	err = removePath(system, system.RootPath(values.StateFile), logger)
+	if err != nil {
+		logger.Logger.Error().Err(err).Str("file", values.StateFile).Msg("Error removing state file.")
+		return err
 	}
+	m.AddRemoved(values.StateFile)
 	// Remove old initrds and kernels
 	// We are only interested in keeping the one linked to /etc/initrd and /etc/vmlinuz
 	// So we read the softlink at /boot/initrd and /boot/vmlinuz and remove the others
 
-	kernels, err := filepath.Glob("/boot/vmlinuz-*")
+	kernels, err := filepath.Glob(system.RootPath("/boot/vmlinuz-*"))
 	if err != nil {
 		return err
 	}
-	var skip string
 	// read the link
-	skip, err = os.Readlink("/boot/vmlinuz")
+	current, err := linkedKernelVersion(system)
 	if err != nil {
+		if system.DryRun() {
+			// On dry-run the kernel is probably not linked yet, so we cant know which ones would be kept
+			logger.Logger.Warn().Err(err).Msg("Kernel not linked yet, cannot know which kernels would be removed.")
+			system.Plan.AddRemoved(system.RootPath("/boot/vmlinuz-*") + " (all but the linked kernel)")
+			return m.Write(system, logger)
+		}
 		logger.Logger.Error().Err(err).Msg("Error reading kernel link.")
 		return err
 	}
-	logger.Logger.Info().Str("current", skip).Msg("Found current kernel.")
+	logger.Logger.Info().Str("current", current).Msg("Found current kernel.")
 
 	for _, kernel := range kernels {
-		logger.Logger.Info().Str("kernel", filepath.Base(kernel)).Str("current", filepath.Base(skip)).Msg("Checking kernel.")
-		if kernel != "/boot/vmlinuz" && filepath.Base(kernel) != filepath.Base(skip) {
+		version := strings.TrimPrefix(filepath.Base(kernel), "vmlinuz-")
+		logger.Logger.Info().Str("kernel", filepath.Base(kernel)).Str("current", current).Msg("Checking kernel.")
+		if version != current {
 			logger.Logger.Info().Str("kernel", kernel).Msg("Removing kernel.")
-			err = os.Remove(kernel)
+			err = removePath(system, kernel, logger)
 			if err != nil {
 				logger.Logger.Error().Err(err).Str("kernel", kernel).Msg("Error removing kernel.")
 				return err
 			}
+			m.AddRemoved(filepath.Join("/boot", filepath.Base(kernel)))
 		}
 	}
 
-	return nil
+	return m.Write(system, logger)
 }
 
 func (c Cleanup) Remove(system values.System, logger sdkTypes.KairosLogger) error {
+	// Removed files cannot be brought back, so there is nothing to undo
+	logger.Logger.Info().Str("feature", c.Name()).Msg("Nothing to remove for the cleanup feature.")
 	return nil
 }
 
@@ -69,6 +90,8 @@ func (c Cleanup) Info(system values.System, logger sdkTypes.KairosLogger) {
 	logger.Logger.Info().Str("feature", c.Name()).Msg("Cleanup feature.")
 }
 
+// Installed always returns false, as there may be new things to clean on every run.
+// Its manifest only records what was removed on the last run
 func (c Cleanup) Installed(system values.System, logger sdkTypes.KairosLogger) bool {
 	return false
 }
@@ -85,6 +108,61 @@ func (c Cleanup) Name() string {
 	return "Cleanup"
 }
 
-func (c Cleanup) GetOrder() int {
-	return c.Order
+// Dependencies returns the features that must be installed before the Cleanup feature.
+// It needs the kernel link to know which kernels to keep
+func (c Cleanup) Dependencies() []string {
+	return []string{"kernel"}
+}
+
+// RunsLast makes the Cleanup feature run after every other feature, as they may leave things to clean
+func (c Cleanup) RunsLast() bool {
+	return true
+}
+
+// Checks returns the checks for the Cleanup feature.
+func (c Cleanup) Checks(system values.System, logger sdkTypes.KairosLogger) []values.Check {
+	return []values.Check{
+		{Name: "machine-id", Fn: func() error {
+			info, err := os.Stat(system.RootPath("/etc/machine-id"))
+			if err != nil {
+				return err
+			}
+			if info.Size() != 0 {
+				return fmt.Errorf("/etc/machine-id is not empty")
+			}
+			return nil
+		}},
+		{Name: "removed files", Fn: func() error {
+			var found []string
+			for _, f := range values.FilesToRemove() {
+				if _, err := os.Lstat(system.RootPath(f)); err == nil {
+					found = append(found, f)
+				}
+			}
+			if len(found) > 0 {
+				return fmt.Errorf("files not removed: %s", strings.Join(found, ", "))
+			}
+			return nil
+		}},
+		{Name: "old kernels", Fn: func() error {
+			current, err := linkedKernelVersion(system)
+			if err != nil {
+				return err
+			}
+			kernels, err := filepath.Glob(system.RootPath("/boot/vmlinuz-*"))
+			if err != nil {
+				return err
+			}
+			var old []string
+			for _, kernel := range kernels {
+				if strings.TrimPrefix(filepath.Base(kernel), "vmlinuz-") != current {
+					old = append(old, filepath.Base(kernel))
+				}
+			}
+			if len(old) > 0 {
+				return fmt.Errorf("old kernels not removed: %s", strings.Join(old, ", "))
+			}
+			return nil
+		}},
+	}
 }
@@ -0,0 +1,46 @@
+package features
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestCleanupInstall(t *testing.T) {
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	s := testSystem(t)
+	writeTestFile(t, s.Root, "/etc/machine-id", "0123456789abcdef0123456789abcdef\n")
+	writeTestFile(t, s.Root, "/boot/vmlinuz-6.1.0-9-amd64", "kernel")
+	writeTestFile(t, s.Root, "/boot/vmlinuz-6.1.0-18-amd64", "kernel")
+	if err := os.Symlink("vmlinuz-6.1.0-18-amd64", s.RootPath(kernelLink)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Cleanup{}
+	if err := c.Install(s, l); err != nil {
+		t.Fatalf("Install() unexpected error: %v", err)
+	}
+	for _, check := range c.Checks(s, l) {
+		if err := check.Fn(); err != nil {
+			t.Errorf("check %s failed: %v", check.Name, err)
+		}
+	}
+	m, err := ReadManifest(s, c.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The machine-id is emptied, so it is still there
+	if slices.Contains(m.Removed, "/etc/machine-id") {
+		t.Errorf("/etc/machine-id recorded as removed: %v", m.Removed)
+	}
+	if !slices.Contains(m.Removed, "/boot/vmlinuz-6.1.0-9-amd64") {
+		t.Errorf("old kernel not recorded as removed: %v", m.Removed)
+	}
+	for _, f := range m.Removed {
+		if _, err = os.Lstat(s.RootPath(f)); err == nil {
+			t.Errorf("%s recorded as removed but still there", f)
+		}
+	}
+}
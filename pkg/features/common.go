@@ -3,24 +3,31 @@ package features
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"fmt"
-	"github.com/Masterminds/semver/v3"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os"
 	"os/exec"
-	"sort"
+	"path/filepath"
+	"slices"
 	"strings"
 )
 
+// Features is the registry of the available features. Their dependencies refer to the names in here
 var Features = map[string]values.Feature{
-	"immutability": Immutability{Order: 1},
-	"release":      KairosRelease{Order: 2},
-	"kernel":       Kernel{Order: 3},
-	"initrd":       Initrd{Order: 5},
-	"clean":        Cleanup{Order: 10},
+	"immutability": Immutability{},
+	"release":      KairosRelease{},
+	"kernel":       Kernel{},
+	"services":     KairosServices{},
+	"initrd":       Initrd{},
+	"kubernetes":   Kubernetes{},
+	"clean":        Cleanup{},
 }
 
+// dryRunKernelVersion is used as kernel version on dry-run when there is no kernel installed yet
+const dryRunKernelVersion = "<latest>"
+
 var FeatSupported = func() []string {
 	var f []string
 	for k := range Features {
@@ -42,16 +49,124 @@ func FeatureSupported(name string) bool {
 	return false
 }
 
-// GetOrderedFeatures Returns the features in order
-func GetOrderedFeatures() []values.Feature {
-	var orderedFeatures []values.Feature
-	for _, feature := range Features {
-		orderedFeatures = append(orderedFeatures, feature)
+// GetOrderedFeatures Returns all the features sorted by their dependencies
+func GetOrderedFeatures(l sdkTypes.KairosLogger) ([]values.Feature, error) {
+	return values.SortFeatures(Features, FeatSupported(), l)
+}
+
+// OrderFeatures returns the features with the given names in the same order they would be installed, without
+// adding their dependencies. Repeated names are only returned once and "all" returns every feature.
+// Used when validating or removing, where we only want to act on the requested features
+func OrderFeatures(names []string, l sdkTypes.KairosLogger) ([]values.Feature, error) {
+	ordered, err := GetOrderedFeatures(l)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(names, "all") {
+		return ordered, nil
+	}
+	for _, name := range names {
+		if !FeatureSupported(name) {
+			return nil, fmt.Errorf("feature %s not supported. Available features: %s", name, strings.Join(FeatSupported(), ", "))
+		}
+	}
+	return slices.DeleteFunc(ordered, func(f values.Feature) bool {
+		return !slices.ContainsFunc(names, func(name string) bool { return GetFeature(name) == f })
+	}), nil
+}
+
+// RunCommand runs the given command on the system, or just records it on the plan when running in dry-run mode
+// If the system lives on a different root, the command is run chrooted into it
+func RunCommand(s values.System, cmd string, args []string, l sdkTypes.KairosLogger) error {
+	if s.Chrooted() {
+		args = append([]string{s.Root, cmd}, args...)
+		cmd = "chroot"
+	}
+	if s.DryRun() {
+		l.Logger.Debug().Str("command", cmd).Strs("args", args).Msg("Dry-run, not running command")
+		s.Plan.AddCommand(cmd, args)
+		return nil
+	}
+	return CommandToLogger(cmd, args, l)
+}
+
+// CommandOutput runs the given command on the system and returns its stdout. It runs even in dry-run mode, so
+// it must only be used for commands that do not change the system, like queries.
+// If the system lives on a different root, the command is run chrooted into it
+func CommandOutput(s values.System, cmd string, args []string, l sdkTypes.KairosLogger) (string, error) {
+	if s.Chrooted() {
+		args = append([]string{s.Root, cmd}, args...)
+		cmd = "chroot"
+	}
+	l.Logger.Debug().Str("command", cmd).Strs("args", args).Msg("Running command")
+	out, err := exec.Command(cmd, args...).Output()
+	return string(out), err
+}
+
+// removePath removes the given path, or just records it on the plan when running in dry-run mode
+func removePath(s values.System, path string, l sdkTypes.KairosLogger) error {
+	if s.DryRun() {
+		l.Logger.Debug().Str("file", path).Msg("Dry-run, not removing file")
+		s.Plan.AddRemoved(path)
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// createFile creates an empty file, truncating it if it exists, or just records it on the plan when running in dry-run mode
+func createFile(s values.System, path string, l sdkTypes.KairosLogger) error {
+	if s.DryRun() {
+		l.Logger.Debug().Str("file", path).Msg("Dry-run, not creating file")
+		s.Plan.AddCreated(path)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeFile writes the data to the given path with the given permissions, creating the parent directories,
+// or just records it on the plan when running in dry-run mode
+func writeFile(s values.System, path string, data []byte, perm os.FileMode, l sdkTypes.KairosLogger) error {
+	if s.DryRun() {
+		l.Logger.Debug().Str("file", path).Msg("Dry-run, not writing file")
+		s.Plan.AddCreated(path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
+		return err
 	}
-	sort.Slice(orderedFeatures, func(i, j int) bool {
-		return orderedFeatures[i].GetOrder() < orderedFeatures[j].GetOrder()
-	})
-	return orderedFeatures
+	l.Logger.Debug().Str("file", path).Msg("Writing file")
+	return os.WriteFile(path, data, perm)
+}
+
+// createLink creates a symlink at path pointing to target, or just records it on the plan when running in dry-run mode.
+// An existing symlink is replaced. It returns false if the link was already there pointing to the same target
+func createLink(s values.System, target, path string, l sdkTypes.KairosLogger) (bool, error) {
+	if s.DryRun() {
+		l.Logger.Debug().Str("link", path).Str("target", target).Msg("Dry-run, not creating link")
+		s.Plan.AddCreated(path)
+		return true, nil
+	}
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false, fmt.Errorf("cannot create link %s, a file already exists", path)
+		}
+		if current, _ := os.Readlink(path); current == target {
+			return false, nil
+		}
+		if err = os.Remove(path); err != nil {
+			return false, err
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
+		return false, err
+	}
+	l.Logger.Debug().Str("link", path).Str("target", target).Msg("Creating link")
+	return true, os.Symlink(target, path)
 }
 
 func CommandToLogger(cmd string, args []string, l sdkTypes.KairosLogger) (err error) {
@@ -87,32 +202,123 @@ func CommandToLogger(cmd string, args []string, l sdkTypes.KairosLogger) (err er
 	return err
 }
 
-func GetLatestKernel(l sdkTypes.KairosLogger) (string, error) {
-	var kernelVersion string
-	modulesPath := "/lib/modules"
-	// Read the directories under /lib/modules
-	dirs, err := os.ReadDir(modulesPath)
-	if err != nil {
-		l.Logger.Error().Msgf("Failed to read the directory %s: %s", modulesPath, err)
-		return kernelVersion, err
+// kernelModulesDirs are the directories where each installed kernel has its modules directory, named as its version
+var kernelModulesDirs = []string{"/lib/modules", "/usr/lib/modules"}
 
+// GetKernelVersion returns the kernel version to use for the system, the pinned one if set or the newest installed
+func GetKernelVersion(s values.System, l sdkTypes.KairosLogger) (string, error) {
+	if s.KernelVersion == "" {
+		return GetLatestKernel(s, l)
 	}
+	for _, dir := range kernelModulesDirs {
+		if info, err := os.Stat(s.RootPath(filepath.Join(dir, s.KernelVersion))); err == nil && info.IsDir() {
+			return s.KernelVersion, nil
+		}
+	}
+	return "", fmt.Errorf("kernel %s not found in %s", s.KernelVersion, strings.Join(kernelModulesDirs, " or "))
+}
 
-	var versions []*semver.Version
-
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			// Parse the directory name as a semver version
-			version, err := semver.NewVersion(dir.Name())
-			if err != nil {
-				l.Logger.Error().Msgf("Failed to parse the version %s: %s", dir.Name(), err)
+// GetLatestKernel returns the newest kernel version installed on the system.
+// Versions are compared naturally, as distros use all kind of naming schemes that are not semver, like
+// 6.1.0-18-amd64, 6.8.5-301.fc40.x86_64 or 6.6.14-0-lts
+func GetLatestKernel(s values.System, l sdkTypes.KairosLogger) (string, error) {
+	var versions []string
+	for _, dir := range kernelModulesDirs {
+		modulesPath := s.RootPath(dir)
+		// Read the directories under the modules dir
+		dirs, err := os.ReadDir(modulesPath)
+		if err != nil {
+			l.Logger.Debug().Err(err).Str("dir", modulesPath).Msg("Cannot read modules directory")
+			continue
+		}
+		for _, d := range dirs {
+			// Skip things like the extramodules dirs on Arch, kernel versions always start with a number
+			if !d.IsDir() || d.Name() == "" || d.Name()[0] < '0' || d.Name()[0] > '9' {
 				continue
 			}
-			versions = append(versions, version)
+			// /lib is usually a link to /usr/lib, so the same kernel can be found twice
+			if !slices.Contains(versions, d.Name()) {
+				versions = append(versions, d.Name())
+			}
 		}
 	}
+	if len(versions) == 0 {
+		err := fmt.Errorf("no kernel found in %s", strings.Join(kernelModulesDirs, " or "))
+		l.Logger.Error().Err(err).Msg("Failed to get the latest kernel")
+		return "", err
+	}
+	slices.SortFunc(versions, compareVersions)
+	latest := versions[len(versions)-1]
+	l.Logger.Debug().Strs("kernels", versions).Str("latest", latest).Msg("Found kernels")
+	return latest, nil
+}
 
-	sort.Sort(semver.Collection(versions))
-	kernelVersion = versions[0].String()
-	return kernelVersion, nil
+// compareVersions compares two version strings with the rpmvercmp rules, so it works for the kernel names of every
+// distro. Separators are ignored, runs of digits are compared as numbers and runs of letters as text, and a number is
+// newer than text, so 6.8.10 is newer than 6.8.9 and 5.14.0-362.8.1.el9_3 is newer than 5.14.0-362.el9.
+// A ~ marks a pre-release and sorts before anything, even the end of the version
+func compareVersions(a, b string) int {
+	for {
+		a, b = strings.TrimLeftFunc(a, isVersionSeparator), strings.TrimLeftFunc(b, isVersionSeparator)
+		aTilde, bTilde := strings.HasPrefix(a, "~"), strings.HasPrefix(b, "~")
+		if aTilde && bTilde {
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if aTilde {
+			return -1
+		}
+		if bTilde {
+			return 1
+		}
+		if a == "" || b == "" {
+			break
+		}
+		var chunkA, chunkB string
+		chunkA, a = nextVersionChunk(a)
+		chunkB, b = nextVersionChunk(b)
+		aNum, bNum := isDigit(rune(chunkA[0])), isDigit(rune(chunkB[0]))
+		if aNum != bNum {
+			if aNum {
+				return 1
+			}
+			return -1
+		}
+		if aNum {
+			// Compare the numbers as text without the leading zeroes, so there is no overflow with long ones
+			chunkA, chunkB = strings.TrimLeft(chunkA, "0"), strings.TrimLeft(chunkB, "0")
+			if c := cmp.Compare(len(chunkA), len(chunkB)); c != 0 {
+				return c
+			}
+		}
+		if c := strings.Compare(chunkA, chunkB); c != 0 {
+			return c
+		}
+	}
+	// Whichever version still has something left is newer
+	return cmp.Compare(len(a), len(b))
 }
+
+// nextVersionChunk returns the leading run of digits or letters of the version and the rest of it.
+// The version must start with a digit or a letter
+func nextVersionChunk(version string) (string, string) {
+	class := isDigit
+	if !isDigit(rune(version[0])) {
+		class = isLetter
+	}
+	i := strings.IndexFunc(version, func(r rune) bool { return !class(r) })
+	if i == -1 {
+		return version, ""
+	}
+	return version[:i], version[i:]
+}
+
+// isVersionSeparator returns true for the characters between the version chunks. Only ascii letters and digits are
+// part of the chunks, and ~ is not a separator but a pre-release mark
+func isVersionSeparator(r rune) bool {
+	return !isDigit(r) && !isLetter(r) && r != '~'
+}
+
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+
+func isLetter(r rune) bool { return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') }
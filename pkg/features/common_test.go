@@ -0,0 +1,81 @@
+package features
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		name  string
+		older string
+		newer string
+	}{
+		{"debian abi", "6.1.0-9-amd64", "6.1.0-18-amd64"},
+		{"debian point release", "6.1.0-18-amd64", "6.12.0-1-amd64"},
+		{"ubuntu", "6.8.0-31-generic", "6.8.0-45-generic"},
+		{"fedora", "6.8.5-301.fc40.x86_64", "6.8.10-300.fc40.x86_64"},
+		{"fedora release", "6.8.5-301.fc40.x86_64", "6.8.5-302.fc40.x86_64"},
+		{"rhel errata", "5.14.0-362.el9.x86_64", "5.14.0-362.8.1.el9_3.x86_64"},
+		{"rhel minor", "5.14.0-362.24.1.el9_3.x86_64", "5.14.0-427.13.1.el9_4.x86_64"},
+		{"opensuse", "6.4.0-150600.21-default", "6.4.0-150600.23.7-default"},
+		{"arch", "6.9.7-arch1-1", "6.10.2-arch1-1"},
+		{"alpine", "6.6.8-0-lts", "6.6.14-0-lts"},
+		{"pre-release", "6.1.0~rc1", "6.1.0"},
+		{"leading zeroes", "6.1.09", "6.1.10"},
+		{"longer", "6.1", "6.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c := compareVersions(tt.older, tt.newer); c != -1 {
+				t.Errorf("compareVersions(%q, %q) = %d, want -1", tt.older, tt.newer, c)
+			}
+			if c := compareVersions(tt.newer, tt.older); c != 1 {
+				t.Errorf("compareVersions(%q, %q) = %d, want 1", tt.newer, tt.older, c)
+			}
+			if c := compareVersions(tt.newer, tt.newer); c != 0 {
+				t.Errorf("compareVersions(%q, %q) = %d, want 0", tt.newer, tt.newer, c)
+			}
+		})
+	}
+}
+
+func TestGetLatestKernel(t *testing.T) {
+	tests := []struct {
+		name    string
+		kernels []string
+		latest  string
+	}{
+		{"debian", []string{"6.1.0-9-amd64", "6.1.0-18-amd64", "6.1.0-17-amd64"}, "6.1.0-18-amd64"},
+		{"rhel errata", []string{"5.14.0-362.8.1.el9_3.x86_64", "5.14.0-362.el9.x86_64"}, "5.14.0-362.8.1.el9_3.x86_64"},
+		{"alpine", []string{"6.6.14-0-lts", "6.6.8-0-lts"}, "6.6.14-0-lts"},
+		// Dirs that do not start with a number are not kernels
+		{"arch extramodules", []string{"extramodules-6.10-arch", "6.10.2-arch1-1"}, "6.10.2-arch1-1"},
+	}
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := values.System{Root: t.TempDir()}
+			for _, k := range tt.kernels {
+				if err := os.MkdirAll(s.RootPath(filepath.Join("/lib/modules", k)), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			latest, err := GetLatestKernel(s, l)
+			if err != nil {
+				t.Fatalf("GetLatestKernel() unexpected error: %v", err)
+			}
+			if latest != tt.latest {
+				t.Errorf("GetLatestKernel() = %s, want %s", latest, tt.latest)
+			}
+		})
+	}
+
+	if _, err := GetLatestKernel(values.System{Root: t.TempDir()}, l); err == nil {
+		t.Error("GetLatestKernel() with no kernels should fail")
+	}
+}
@@ -0,0 +1,217 @@
+package features
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/archive/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	sdkUtils "github.com/kairos-io/kairos-sdk/utils"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// frameworkReleaseKeys are the keys written to the release file when installing the framework
+var frameworkReleaseKeys = []string{"KAIROS_FRAMEWORK_IMAGE", "KAIROS_FRAMEWORK_DIGEST"}
+
+// installFramework extracts the framework into the system root, from a registry or from a local source.
+// It returns the digest of the framework that was installed and the paths it laid down
+func installFramework(s values.System, source string, l sdkTypes.KairosLogger) (string, []string, error) {
+	reader, digest, err := openSource(s, source, l)
+	if err != nil {
+		l.Logger.Error().Err(err).Str("source", source).Msg("Error opening framework.")
+		return "", nil, err
+	}
+	defer reader.Close()
+	files, err := extractTar(s, reader, l)
+	if err != nil {
+		return "", nil, fmt.Errorf("extracting framework %s: %w", source, err)
+	}
+	return digest, files, nil
+}
+
+// openSource returns the files from the source as a tar stream and its digest.
+// The source can be an image reference or a local path to an OCI layout directory, a docker save tarball
+// or a plain rootfs tarball, so the files can be installed without access to a registry
+func openSource(s values.System, source string, l sdkTypes.KairosLogger) (io.ReadCloser, string, error) {
+	platform := v1.Platform{OS: "linux", Architecture: s.Arch.String()}
+	info, err := os.Stat(source)
+	if err != nil {
+		// Not a local path, pull it
+		l.Logger.Debug().Str("image", source).Str("platform", platform.String()).Msg("Pulling image")
+		img, err := sdkUtils.GetImage(source, platform.String(), nil, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("getting image %s for %s: %w", source, platform.String(), err)
+		}
+		return openImage(img)
+	}
+
+	if info.IsDir() {
+		l.Logger.Debug().Str("path", source).Str("platform", platform.String()).Msg("Reading OCI layout")
+		idx, err := layout.ImageIndexFromPath(source)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading OCI layout %s: %w", source, err)
+		}
+		img, err := imageFromIndex(idx, platform)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading OCI layout %s: %w", source, err)
+		}
+		return openImage(img)
+	}
+
+	// A docker save tarball has a manifest.json, otherwise we consider it a rootfs tarball
+	isImage, err := hasImageManifest(source)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading tarball %s: %w", source, err)
+	}
+	if !isImage {
+		l.Logger.Debug().Str("path", source).Msg("Reading rootfs tarball")
+		return openRootfsTarball(source)
+	}
+	l.Logger.Debug().Str("path", source).Msg("Reading image tarball")
+	img, err := tarball.ImageFromPath(source, nil)
+	if err != nil {
+		// Do not fall back to a rootfs tarball, or the image files would be extracted into the root
+		return nil, "", fmt.Errorf("reading image tarball %s: %w", source, err)
+	}
+	return openImage(img)
+}
+
+// hasImageManifest returns true if the tarball has a manifest.json at its top level, like docker save ones
+func hasImageManifest(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	reader, err := compression.DecompressStream(f)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if filepath.Clean(header.Name) == "manifest.json" {
+			return true, nil
+		}
+	}
+}
+
+// openImage returns the flattened filesystem of the image and its digest
+func openImage(img v1.Image) (io.ReadCloser, string, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, "", fmt.Errorf("getting image digest: %w", err)
+	}
+	return mutate.Extract(img), digest.String(), nil
+}
+
+// imageFromIndex returns the image from the index that matches the platform, looking into nested indexes.
+// Indexes with a single image and no platform, as created by most tools for a single arch, return that image
+func imageFromIndex(idx v1.ImageIndex, platform v1.Platform) (v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			nested, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if img, err := imageFromIndex(nested, platform); err == nil {
+				return img, nil
+			}
+		case desc.MediaType.IsImage():
+			if (desc.Platform == nil && len(manifest.Manifests) == 1) || (desc.Platform != nil && desc.Platform.Satisfies(platform)) {
+				return idx.Image(desc.Digest)
+			}
+		}
+	}
+	return nil, fmt.Errorf("no image found for platform %s", platform.String())
+}
+
+// openRootfsTarball returns the decompressed contents of the tarball and the digest of the file
+func openRootfsTarball(path string) (io.ReadCloser, string, error) {
+	digest, err := fileChecksum(path)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	reader, err := compression.DecompressStream(f)
+	if err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("reading rootfs tarball %s: %w", path, err)
+	}
+	return &rootfsTarball{ReadCloser: reader, file: f}, "sha256:" + digest, nil
+}
+
+// rootfsTarball closes both the decompressor and the underlying file
+type rootfsTarball struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *rootfsTarball) Close() error {
+	err := r.ReadCloser.Close()
+	if fileErr := r.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// extractTar extracts the tar stream into the system root and returns the paths it laid down.
+// Directories are not returned, as those are usually shared with the rest of the system
+func extractTar(s values.System, reader io.Reader, l sdkTypes.KairosLogger) ([]string, error) {
+	var files []string
+	// Read the headers from a copy of the stream while it is being applied, so we dont need to read it twice
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		tr := tar.NewReader(pr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// Keep draining so the extraction is not blocked
+				_, _ = io.Copy(io.Discard, pr)
+				done <- err
+				return
+			}
+			if header.Typeflag != tar.TypeDir {
+				files = append(files, filepath.Join("/", header.Name))
+			}
+		}
+		_, _ = io.Copy(io.Discard, pr)
+		done <- nil
+	}()
+
+	_, err := archive.Apply(context.Background(), s.RootPath("/"), io.TeeReader(reader, pw))
+	_ = pw.CloseWithError(err)
+	listErr := <-done
+	if err != nil {
+		l.Logger.Error().Err(err).Str("root", s.RootPath("/")).Msg("Error extracting files.")
+		return files, err
+	}
+	return files, listErr
+}
@@ -3,21 +3,19 @@
 package features
 
 import (
-	"github.com/Masterminds/semver/v3"
+	"errors"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
-	sdkUtils "github.com/kairos-io/kairos-sdk/utils"
 	"os"
 )
 
 // Immutability represents the Immutability feature.
 // This install immucore and its required packages to run.
-type Immutability struct {
-	Order int
-}
+type Immutability struct{}
 
-func (g Immutability) GetOrder() int {
-	return g.Order
+// Dependencies returns the features that must be installed before the Immutability feature.
+func (g Immutability) Dependencies() []string {
+	return []string{}
 }
 
 func (g Immutability) Name() string {
@@ -26,81 +24,109 @@ func (g Immutability) Name() string {
 
 // Install installs the Immutability feature.
 func (g Immutability) Install(s values.System, l sdkTypes.KairosLogger) error {
-	// Get the packages to install for this system
-	packages, err := getPackages(s, l)
-
-	// Now parse the packages with the templating engine
-	finalMergedPkgs, err := values.PackageListToTemplate(packages, s.GetTemplateParams(), l)
-	if err != nil {
-		l.Logger.Error().Err(err).Msg("Error parsing base packages.")
+	if err := s.CheckInstaller(); err != nil {
 		return err
 	}
-	err = s.Installer.Install(finalMergedPkgs, l)
+	m, err := LoadManifest(s, g.Name())
 	if err != nil {
 		return err
 	}
-
-	l.Logger.Debug().Msg("Installing framework")
-	frameworkImage, err := sdkUtils.GetImage("quay.io/kairos/framework:v2.14.4", "", nil, nil)
-	err = sdkUtils.ExtractOCIImage(frameworkImage, "/")
-	l.Logger.Debug().Msg("Installed framework")
-
-	// Install config files that affect initramfs and rootfs only, which are the ones that affect immucore?
-	err = os.MkdirAll("/etc/kairos", os.ModeDir|os.ModePerm)
+	// Get the packages to install for this system, already templated
+	finalMergedPkgs, err := getPackages(s, l)
 	if err != nil {
 		return err
 	}
-	_, err = os.Create(values.ImmutabilitySentinel)
-	if err != nil {
-		return err
+	if s.DryRun() {
+		s.Plan.AddPackages(finalMergedPkgs...)
 	}
-	return nil
-}
-
-// getPackages returns the packages to install for the Immutability feature.
-// It parses the package maps and returns the packages that match the system version with semver
-func getPackages(s values.System, l sdkTypes.KairosLogger) ([]string, error) {
-	mergedPkgs := values.CommonPackages
-	version, err := semver.NewVersion(s.Version)
+	// Check what is already there, so we only record the packages that we really installed
+	var before map[string]string
+	if !s.DryRun() {
+		before, err = s.Installer.Query(s, finalMergedPkgs, l)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.Installer.Install(s, finalMergedPkgs, l)
 	if err != nil {
-		l.Logger.Error().Err(err).Str("version", s.Version).Msg("Error parsing version.")
-		return mergedPkgs, err
+		return err
 	}
-
-	// Go over all packages maps
-	for _, packages := range []values.VersionMap{
-		values.BasePackages[s.Distro][s.Arch],
-		values.ImmucorePackages[s.Distro][s.Arch], // immucore packages should only be installed under grub
-		values.KernelPackages[s.Distro][s.Arch],
-		values.GrubPackages[s.Distro][s.Arch],    // grub packages should only be installed under grub
-		values.SystemdPackages[s.Distro][s.Arch], // systemd packages should only be installed under trusted boot
-	} {
-		// for each package map, check if the version matches the constraint
-		for k, v := range packages {
-			// Add them if they are common
-			l.Logger.Debug().Str("constraint", k).Str("version", version.String()).Msg("Checking constraint")
-			if k == values.Common {
-				mergedPkgs = append(mergedPkgs, v...)
-				continue
-			}
-			constraint, err := semver.NewConstraint(k)
-			if err != nil {
-				l.Logger.Error().Err(err).Str("constraint", k).Msg("Error parsing constraint.")
+	if !s.DryRun() {
+		after, err := s.Installer.Query(s, finalMergedPkgs, l)
+		if err != nil {
+			return err
+		}
+		for _, p := range finalMergedPkgs {
+			if _, ok := before[p]; ok {
 				continue
 			}
-			// Also add them if the constraint matches
-			if constraint.Check(version) {
-				mergedPkgs = append(mergedPkgs, v...)
+			if version, ok := after[p]; ok {
+				m.AddPackage(p, version)
+				// Packages can be listed more than once in different categories
+				before[p] = version
 			}
 		}
 	}
 
-	return mergedPkgs, nil
+	image := s.GetFrameworkImage()
+	l.Logger.Debug().Str("image", image).Msg("Installing framework")
+	if s.DryRun() {
+		s.Plan.AddImage(image, s.RootPath("/"))
+		if err = writeReleaseKeys(s, map[string]string{"KAIROS_FRAMEWORK_IMAGE": image}, l); err != nil {
+			return err
+		}
+		return m.Write(s, l)
+	}
+	digest, files, err := installFramework(s, image, l)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err = m.AddFile(s, f); err != nil {
+			return err
+		}
+	}
+	l.Logger.Debug().Str("image", image).Str("digest", digest).Msg("Installed framework")
+
+	// Record the resolved digest, so the same framework can be installed again by using it as the reference
+	err = writeReleaseKeys(s, map[string]string{
+		"KAIROS_FRAMEWORK_IMAGE":  image,
+		"KAIROS_FRAMEWORK_DIGEST": digest,
+	}, l)
+	if err != nil {
+		return err
+	}
+	return m.Write(s, l)
 }
 
 // Remove removes the Immutability feature.
+// It uninstalls the packages and removes the files laid down by the framework image, as recorded on its manifest
 func (g Immutability) Remove(s values.System, l sdkTypes.KairosLogger) error {
-	return nil
+	m, err := ReadManifest(s, g.Name())
+	if errors.Is(err, os.ErrNotExist) {
+		l.Logger.Info().Str("feature", g.Name()).Msg("No manifest found, feature is not installed.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var packages []string
+	for _, p := range m.Packages {
+		packages = append(packages, p.Name)
+	}
+	if len(packages) > 0 {
+		if err = s.CheckInstaller(); err != nil {
+			return err
+		}
+		if err = s.Installer.Remove(s, packages, l); err != nil {
+			return err
+		}
+	}
+	l.Logger.Debug().Msg("Removing framework files")
+	if err = removeReleaseKeys(s, frameworkReleaseKeys, l); err != nil {
+		return err
+	}
+	return m.RemoveFiles(s, l)
 }
 
 // Info logs information about the Immutability feature.
@@ -120,13 +146,18 @@ func (g Immutability) InstallsPackages() bool {
 
 // Installed returns true if the Immutability feature is installed.
 func (g Immutability) Installed(s values.System, l sdkTypes.KairosLogger) bool {
-	if s.Force {
-		return false
+	return manifestInstalled(s, g.Name())
+}
+
+// Checks returns the checks for the Immutability feature.
+// Under trusted boot, systemd needs to be new enough to boot the UKI
+func (g Immutability) Checks(s values.System, l sdkTypes.KairosLogger) []values.Check {
+	checks := []values.Check{
+		{Name: "binaries", Fn: func() error { return checkBinaries(s, values.BinariesCheck(s.GetBootMode())) }},
+		{Name: "packages", Fn: func() error { return checkPackages(s, l) }},
 	}
-	// Check sentinel
-	_, err := os.Stat(values.ImmutabilitySentinel)
-	if err != nil {
-		return false
+	if s.GetBootMode() == values.TrustedBoot {
+		checks = append(checks, values.Check{Name: "systemd version", Fn: func() error { return checkSystemdVersion(s, l) }})
 	}
-	return true
+	return checks
 }
@@ -0,0 +1,250 @@
+package features
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The initrd is a concatenation of cpio archives in the "newc" format, each one optionally compressed.
+// Usually there is an uncompressed one first with the cpu microcode, followed by a compressed one with the rest
+// of the initramfs, so we walk all of them to know what ends inside the initrd.
+
+// dracutModulesFile lists the dracut modules that were included in the initrd, one per line
+const dracutModulesFile = "usr/lib/dracut/modules.txt"
+
+// cpioHeaderSize is the size of a "newc" header: the magic and 13 fields of 8 hex characters
+const cpioHeaderSize = 110
+
+const cpioTrailer = "TRAILER!!!"
+
+// Limits for what is read into memory from the cpio archives, so a corrupt initrd cannot make us allocate gigabytes.
+// Entry names are paths, and the dracut modules list is a few hundred bytes
+const (
+	maxCPIONameSize   = 4096
+	maxDracutListSize = 1 << 20
+)
+
+var (
+	cpioMagic      = []byte("07070")
+	gzipMagic      = []byte{0x1f, 0x8b}
+	zstdMagic      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic        = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	lz4Magic       = []byte{0x04, 0x22, 0x4d, 0x18}
+	lz4LegacyMagic = []byte{0x02, 0x21, 0x4c, 0x18}
+)
+
+// initrdContents is what was found inside the initrd
+type initrdContents struct {
+	Files   map[string]bool // Paths without the leading slash, like usr/bin/immucore
+	Modules map[string]bool // Dracut modules, as listed on dracutModulesFile
+}
+
+// HasAny returns true if any of the paths, separated by "|", is in the initrd
+func (c initrdContents) HasAny(paths string) bool {
+	for _, p := range strings.Split(paths, "|") {
+		if c.Files[strings.TrimPrefix(p, "/")] {
+			return true
+		}
+	}
+	return false
+}
+
+// readInitrd walks all the archives of the initrd at path and returns its contents
+func readInitrd(path string) (initrdContents, error) {
+	contents := initrdContents{Files: map[string]bool{}, Modules: map[string]bool{}}
+	f, err := os.Open(path)
+	if err != nil {
+		return contents, err
+	}
+	defer f.Close()
+	if err = readInitrdSegments(f, contents); err != nil {
+		return contents, fmt.Errorf("reading initrd %s: %w", path, err)
+	}
+	return contents, nil
+}
+
+// readInitrdSegments reads the cpio archives from the reader until the end. Once a compressed segment is found the
+// rest of the archives are read from the decompressed stream, as there is no way to know where it ends on the
+// original one
+func readInitrdSegments(r io.Reader, contents initrdContents) error {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	for {
+		// Archives are padded with zeroes, that can be skipped
+		if err := cr.skipZeroes(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		magic, err := cr.r.Peek(6)
+		if err != nil && len(magic) == 0 {
+			return err
+		}
+		if bytes.HasPrefix(magic, cpioMagic) {
+			if err = readCPIO(cr, contents); err != nil {
+				return err
+			}
+			continue
+		}
+		decompressed, err := decompressor(magic, cr)
+		if err != nil {
+			return err
+		}
+		err = readInitrdSegments(decompressed, contents)
+		if closer, ok := decompressed.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return err
+	}
+}
+
+// decompressor returns a reader that decompresses r, by looking at its magic bytes
+func decompressor(magic []byte, r io.Reader) (io.Reader, error) {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return xz.NewReader(r)
+	case bytes.HasPrefix(magic, lz4Magic), bytes.HasPrefix(magic, lz4LegacyMagic):
+		// The kernel uses the legacy lz4 format, which the reader detects
+		return lz4.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown initrd format with magic %x", magic)
+}
+
+// readCPIO reads a single "newc" archive until its trailer, recording the entries on the contents
+func readCPIO(cr *countingReader, contents initrdContents) error {
+	header := make([]byte, cpioHeaderSize)
+	for {
+		if _, err := io.ReadFull(cr, header); err != nil {
+			return fmt.Errorf("reading cpio header: %w", err)
+		}
+		if !bytes.HasPrefix(header, cpioMagic) {
+			return fmt.Errorf("bad cpio magic %q", header[:6])
+		}
+		// Fields after the magic: ino, mode, uid, gid, nlink, mtime, filesize, devmajor, devminor, rdevmajor,
+		// rdevminor, namesize and check
+		size, err := cpioField(header, 6)
+		if err != nil {
+			return err
+		}
+		nameSize, err := cpioField(header, 11)
+		if err != nil {
+			return err
+		}
+		if nameSize > maxCPIONameSize {
+			return fmt.Errorf("cpio entry name size %d is over the %d limit", nameSize, maxCPIONameSize)
+		}
+		name := make([]byte, nameSize)
+		if _, err = io.ReadFull(cr, name); err != nil {
+			return fmt.Errorf("reading cpio entry name: %w", err)
+		}
+		if err = cr.align(); err != nil {
+			return err
+		}
+		entry := string(bytes.TrimRight(name, "\x00"))
+		if entry == cpioTrailer {
+			return nil
+		}
+		entry = strings.TrimPrefix(filepath.Clean("/"+entry), "/")
+		contents.Files[entry] = true
+
+		if entry == dracutModulesFile {
+			if size > maxDracutListSize {
+				return fmt.Errorf("%s size %d is over the %d limit", dracutModulesFile, size, maxDracutListSize)
+			}
+			data := make([]byte, size)
+			if _, err = io.ReadFull(cr, data); err != nil {
+				return err
+			}
+			for _, module := range strings.Fields(string(data)) {
+				contents.Modules[module] = true
+			}
+		} else if err = cr.skip(size); err != nil {
+			return err
+		}
+		if err = cr.align(); err != nil {
+			return err
+		}
+	}
+}
+
+// cpioField parses the nth field of a "newc" header
+func cpioField(header []byte, n int) (int64, error) {
+	start := 6 + n*8
+	value, err := strconv.ParseInt(string(header[start:start+8]), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad cpio header field %q: %w", header[start:start+8], err)
+	}
+	return value, nil
+}
+
+// countingReader keeps track of the read bytes, as cpio entries are aligned to 4 bytes from the archive start
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// skip discards the next n bytes
+func (c *countingReader) skip(n int64) error {
+	_, err := io.CopyN(io.Discard, c, n)
+	return err
+}
+
+// align discards the padding up to the next 4 bytes boundary
+func (c *countingReader) align() error {
+	return c.skip((4 - c.n%4) % 4)
+}
+
+// skipZeroes discards zero bytes until something else is found. Returns io.EOF if there is nothing else
+func (c *countingReader) skipZeroes() error {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return c.r.UnreadByte()
+		}
+		c.n++
+	}
+}
+
+// missingInitrdContents returns the required modules and files that are not in the initrd
+func missingInitrdContents(contents initrdContents, modules, files []string) error {
+	var errs []error
+	for _, module := range modules {
+		if !contents.Modules[module] {
+			errs = append(errs, fmt.Errorf("dracut module %s not in the initrd", module))
+		}
+	}
+	for _, file := range files {
+		if !contents.HasAny(file) {
+			errs = append(errs, fmt.Errorf("%s not in the initrd", strings.ReplaceAll(file, "|", " or ")))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,208 @@
+package features
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// cpioEntry is an entry for a generated "newc" archive. The sizes on the header are taken from the name and data
+// unless set, to build broken archives
+type cpioEntry struct {
+	name     string
+	data     string
+	nameSize int64
+	fileSize int64
+}
+
+// cpioArchive builds a "newc" archive with the entries and its trailer
+func cpioArchive(entries ...cpioEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range append(entries, cpioEntry{name: cpioTrailer}) {
+		writeCPIOEntry(&buf, e)
+	}
+	return buf.Bytes()
+}
+
+// writeCPIOEntry writes the header, name and data of the entry, padded to 4 bytes like the kernel expects
+func writeCPIOEntry(buf *bytes.Buffer, e cpioEntry) {
+	nameSize, fileSize := e.nameSize, e.fileSize
+	if nameSize == 0 {
+		nameSize = int64(len(e.name) + 1)
+	}
+	if fileSize == 0 {
+		fileSize = int64(len(e.data))
+	}
+	// ino, mode, uid, gid, nlink, mtime, filesize, devmajor, devminor, rdevmajor, rdevminor, namesize and check
+	fmt.Fprintf(buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x", 1, 0100644, 0, 0, 1, 0, fileSize, 0, 0, 0, 0, nameSize, 0)
+	buf.WriteString(e.name + "\x00")
+	pad(buf)
+	buf.WriteString(e.data)
+	pad(buf)
+}
+
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// compress compresses the data with the given writer
+func compress(t *testing.T, data []byte, writer func(io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := writer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadInitrdSegments(t *testing.T) {
+	microcode := cpioArchive(cpioEntry{name: "kernel/x86/microcode/GenuineIntel.bin", data: "ucode"})
+	initramfs := cpioArchive(
+		cpioEntry{name: "usr"},
+		cpioEntry{name: "usr/bin/immucore", data: "binary"},
+		cpioEntry{name: "./usr/bin/kairos-agent", data: "binary"},
+		cpioEntry{name: dracutModulesFile, data: "systemd\nimmucore\ndmsquash-live\n"},
+	)
+	compressors := map[string]func(io.Writer) (io.WriteCloser, error){
+		"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		"zstd": func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		"xz":   func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		"lz4":  func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+	}
+	wantFiles := []string{"kernel/x86/microcode/GenuineIntel.bin", "usr/bin/immucore", "usr/bin/kairos-agent", dracutModulesFile}
+	wantModules := []string{"systemd", "immucore", "dmsquash-live"}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"uncompressed", append(bytes.Clone(microcode), initramfs...)},
+		// The kernel allows zero padding between the archives
+		{"padded", append(append(bytes.Clone(microcode), make([]byte, 512)...), initramfs...)},
+	}
+	for name, writer := range compressors {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{"microcode and " + name, append(bytes.Clone(microcode), compress(t, initramfs, writer)...)})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := initrdContents{Files: map[string]bool{}, Modules: map[string]bool{}}
+			if err := readInitrdSegments(bytes.NewReader(tt.data), contents); err != nil {
+				t.Fatalf("readInitrdSegments() unexpected error: %v", err)
+			}
+			for _, f := range wantFiles {
+				if !contents.Files[f] {
+					t.Errorf("file %s not found, got %v", f, contents.Files)
+				}
+			}
+			for _, m := range wantModules {
+				if !contents.Modules[m] {
+					t.Errorf("module %s not found, got %v", m, contents.Modules)
+				}
+			}
+		})
+	}
+}
+
+func TestReadInitrdSegmentsErrors(t *testing.T) {
+	valid := cpioArchive(cpioEntry{name: "usr/bin/immucore", data: "binary"})
+	trailer := len(valid) - cpioHeaderSize - len(cpioTrailer) - 3
+	// corrupt returns a copy of the valid archive with the bytes at the offset replaced
+	corrupt := func(offset int, with string) []byte {
+		data := bytes.Clone(valid)
+		copy(data[offset:], with)
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"truncated header", valid[:cpioHeaderSize/2], "reading cpio header"},
+		{"truncated name", valid[:cpioHeaderSize+4], "reading cpio entry name"},
+		{"missing trailer", valid[:trailer], "reading cpio header"},
+		{"bad magic", corrupt(trailer, "123456"), "bad cpio magic"},
+		{"bad filesize", corrupt(6+6*8, "zzzzzzzz"), "bad cpio header field"},
+		{"unknown format", []byte("not an initrd"), "unknown initrd format"},
+		{
+			name: "oversized name",
+			data: cpioArchive(cpioEntry{name: "usr/bin/immucore", nameSize: 0xffffffff}),
+			err:  "name size 4294967295 is over the 4096 limit",
+		},
+		{
+			name: "oversized modules list",
+			data: cpioArchive(cpioEntry{name: dracutModulesFile, data: "systemd", fileSize: 0xffffffff}),
+			err:  "size 4294967295 is over the 1048576 limit",
+		},
+		{
+			// Other files are skipped instead of read, so a big size only fails when the data runs out
+			name: "oversized file",
+			data: cpioArchive(cpioEntry{name: "usr/bin/immucore", data: "binary", fileSize: 0xffffffff}),
+			err:  "EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := initrdContents{Files: map[string]bool{}, Modules: map[string]bool{}}
+			err := readInitrdSegments(bytes.NewReader(tt.data), contents)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("readInitrdSegments() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMissingInitrdContents(t *testing.T) {
+	contents := initrdContents{
+		Files:   map[string]bool{"bin/immucore": true},
+		Modules: map[string]bool{"immucore": true},
+	}
+	tests := []struct {
+		name    string
+		modules []string
+		files   []string
+		missing []string
+	}{
+		{"all there", []string{"immucore"}, []string{"usr/bin/immucore|bin/immucore"}, nil},
+		{"leading slash", nil, []string{"/bin/immucore"}, nil},
+		{"missing module", []string{"immucore", "dmsquash-live"}, nil, []string{"dracut module dmsquash-live"}},
+		{"missing file", nil, []string{"usr/bin/kairos-agent|bin/kairos-agent"}, []string{"usr/bin/kairos-agent or bin/kairos-agent"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := missingInitrdContents(contents, tt.modules, tt.files)
+			if len(tt.missing) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error about %v", tt.missing)
+			}
+			for _, m := range tt.missing {
+				if !strings.Contains(err.Error(), m) {
+					t.Errorf("error %q does not mention %s", err, m)
+				}
+			}
+		})
+	}
+}
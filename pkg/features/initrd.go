@@ -3,7 +3,6 @@ package features
 import (
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
-	"os"
 	"path/filepath"
 )
 
@@ -11,12 +10,15 @@ import (
 // It implements the Feature interface.
 
 // Initrd represents the Initrd feature.
-type Initrd struct {
-	Order int
-}
+type Initrd struct{}
+
+// initrdLink is where the initrd for the kernel in use is linked
+const initrdLink = "/boot/initrd"
 
-func (g Initrd) GetOrder() int {
-	return g.Order
+// Dependencies returns the features that must be installed before the Initrd feature.
+// The kernel needs to be in place and dracut needs the immucore modules
+func (g Initrd) Dependencies() []string {
+	return []string{"kernel", "immutability"}
 }
 
 func (g Initrd) Name() string {
@@ -24,36 +26,66 @@ func (g Initrd) Name() string {
 }
 
 // Install installs the Initrd feature.
+// Under trusted boot there is no initrd to generate, as it is built as part of the UKI
 func (g Initrd) Install(s values.System, l sdkTypes.KairosLogger) error {
-	kernelVersion, err := GetLatestKernel(l)
+	if s.GetBootMode() == values.TrustedBoot {
+		l.Logger.Info().Msg("Trusted boot, not generating an initrd.")
+		return nil
+	}
+	kernelVersion, err := GetKernelVersion(s, l)
 	if err != nil {
-		return err
+		if !s.DryRun() {
+			return err
+		}
+		l.Logger.Warn().Err(err).Msg("No kernel found, using a placeholder for the dry-run")
+		kernelVersion = dryRunKernelVersion
 	}
 	// Remove existing initrd files
-	matches, err := filepath.Glob("/boot/initrd*")
+	matches, err := filepath.Glob(s.RootPath("/boot/initrd*"))
 	if err != nil {
 		return err
 	}
 
-	// Print the matched files
+	m, err := LoadManifest(s, g.Name())
+	if err != nil {
+		return err
+	}
 	for _, match := range matches {
-		err = os.Remove(match)
+		err = removePath(s, match, l)
 		if err != nil {
 			return err
 		}
+		path, err := systemPath(s, match)
+		if err != nil {
+			return err
+		}
+		m.AddRemoved(path)
 	}
+	// dracut runs chrooted into the system so the paths are not prefixed with the root
+	initrd := "/boot/initrd-" + kernelVersion
 	cmd := "dracut"
-	args := []string{"-v", "-f", "/boot/initrd", kernelVersion}
+	args := []string{"-v", "-f", initrd, kernelVersion}
 	l.Logger.Debug().Str("command", cmd).Strs("args", args).Msg("Running command")
-	if err := CommandToLogger(cmd, args, l); err != nil {
+	if err := RunCommand(s, cmd, args, l); err != nil {
+		return err
+	}
+	if s.DryRun() {
+		s.Plan.AddCreated(s.RootPath(initrd))
+	}
+	if err = m.AddFile(s, initrd); err != nil {
+		return err
+	}
+	// Link it like the kernel, so the bootloader config does not need to know the version
+	if err = addLink(s, filepath.Base(initrd), initrdLink, m, l); err != nil {
 		return err
 	}
-	return nil
+	return m.Write(s, l)
 }
 
 // Remove removes the Initrd feature.
 func (g Initrd) Remove(s values.System, l sdkTypes.KairosLogger) error {
-	return nil
+	// Remove the generated initrd files
+	return removeFromManifest(s, g.Name(), l)
 }
 
 // Info logs information about the Initrd feature.
@@ -72,11 +104,31 @@ func (g Initrd) InstallsPackages() bool {
 }
 
 // Installed returns true if the Initrd feature is installed.
+// Under trusted boot there is nothing to generate, but it is not reported as installed so it runs if the boot mode
+// changes later
 func (g Initrd) Installed(s values.System, l sdkTypes.KairosLogger) bool {
-	// Check if the initrd file exists
-	if _, err := os.Stat("/boot/initrd"); err == nil {
+	if manifestInstalled(s, g.Name()) {
 		l.Logger.Debug().Msg("Initrd is already generated")
 		return true
 	}
 	return false
 }
+
+// Checks returns the checks for the Initrd feature.
+// There is nothing to check under trusted boot, as the initrd is part of the UKI
+func (g Initrd) Checks(s values.System, l sdkTypes.KairosLogger) []values.Check {
+	if s.GetBootMode() == values.TrustedBoot {
+		return nil
+	}
+	return []values.Check{
+		{Name: "initrd link", Fn: func() error { return checkLink(s, initrdLink) }},
+		{Name: "initrd contents", Fn: func() error {
+			contents, err := readInitrd(s.RootPath(initrdLink))
+			if err != nil {
+				return err
+			}
+			l.Logger.Debug().Int("files", len(contents.Files)).Int("modules", len(contents.Modules)).Msg("Read initrd")
+			return missingInitrdContents(contents, values.InitrdModulesCheck(), values.InitrdFilesCheck(s.InitSystem()))
+		}},
+	}
+}
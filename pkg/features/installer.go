@@ -1,9 +1,12 @@
 package features
 
 import (
+	"fmt"
+	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os"
-	"os/exec"
+	"slices"
+	"strings"
 )
 
 type Installer string
@@ -16,59 +19,121 @@ const (
 	AlpineInstaller Installer = "apk"
 )
 
-func (i Installer) Install(packages []string, l sdkTypes.KairosLogger) error {
+// Installers returns all the known installers
+func Installers() []Installer {
+	return []Installer{APTInstaller, DNFInstaller, PacmanInstaller, SUSEInstaller, AlpineInstaller}
+}
+
+func (i Installer) Install(s values.System, packages []string, l sdkTypes.KairosLogger) error {
 	var args []string
 	var updateArgs []string
 	cmd := string(i)
 	l.Logger.Info().Str("installer", string(i)).Msg("Installing packages")
 	switch i {
-	case APTInstaller, DNFInstaller, SUSEInstaller:
+	case APTInstaller:
 		os.Setenv("DEBIAN_FRONTEND", "noninteractive")
 		defer os.Unsetenv("DEBIAN_FRONTEND")
 		updateArgs = []string{"-y", "update"}
 		args = []string{"-y", "--no-install-recommends", "install"}
+	case DNFInstaller:
+		// dnf has no --no-install-recommends, weak deps are the equivalent
+		updateArgs = []string{"-y", "makecache"}
+		args = []string{"-y", "--setopt=install_weak_deps=False", "install"}
+	case SUSEInstaller:
+		updateArgs = []string{"--non-interactive", "refresh"}
+		args = []string{"--non-interactive", "install", "--no-recommends"}
 	case AlpineInstaller:
 		updateArgs = []string{"update"}
 		args = []string{"add", "--no-cache"}
 	case PacmanInstaller:
 		updateArgs = []string{"-Sy"}
-		args = []string{"-S", "--noconfirm"}
+		args = []string{"-S", "--noconfirm", "--needed"}
 	}
 	// Run update
 	l.Logger.Debug().Str("command", cmd).Strs("args", updateArgs).Msg("Running update")
-	if err := CommandToLogger(cmd, updateArgs, l); err != nil {
+	if err := RunCommand(s, cmd, updateArgs, l); err != nil {
 		return err
 	}
 
 	// Run install
 	args = append(args, packages...)
 	l.Logger.Debug().Str("command", cmd).Strs("args", args).Msg("Running command")
-	if err := CommandToLogger(cmd, args, l); err != nil {
+	if err := RunCommand(s, cmd, args, l); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (i Installer) Remove(packages []string, l sdkTypes.KairosLogger) error {
+func (i Installer) Remove(s values.System, packages []string, l sdkTypes.KairosLogger) error {
 	var args []string
 	cmd := string(i)
 	l.Logger.Info().Str("installer", string(i)).Msg("Removing packages")
 	switch i {
-	case APTInstaller, DNFInstaller, SUSEInstaller:
+	case APTInstaller, DNFInstaller:
 		args = []string{"-y", "remove"}
+	case SUSEInstaller:
+		args = []string{"--non-interactive", "remove"}
 	case AlpineInstaller:
-		args = []string{"remove", "--no-cache"}
+		args = []string{"del", "--no-cache"}
 	case PacmanInstaller:
 		args = []string{"-R", "--noconfirm"}
 	}
 	args = append(args, packages...)
 	l.Logger.Debug().Str("command", cmd).Strs("args", args).Msg("Running command")
-	command := exec.Command(cmd, args...)
-	out, err := command.CombinedOutput()
-	if err != nil {
-		l.Logger.Err(err).Str("output", string(out)).Str("command", cmd).Strs("args", args).Msg("Error running command")
-		return err
+	return RunCommand(s, cmd, args, l)
+}
+
+// Query returns the installed version of the given packages. Packages that are not installed are not returned
+func (i Installer) Query(s values.System, packages []string, l sdkTypes.KairosLogger) (map[string]string, error) {
+	installed := map[string]string{}
+	switch i {
+	case APTInstaller:
+		// dpkg-query exits with error if any package is unknown, but still prints the known ones
+		args := append([]string{"-W", "-f", "${Package}\t${Version}\t${db:Status-Status}\n"}, packages...)
+		out, _ := CommandOutput(s, "dpkg-query", args, l)
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) == 3 && fields[2] == "installed" {
+				installed[fields[0]] = fields[1]
+			}
+		}
+	case DNFInstaller, SUSEInstaller:
+		// Query one by one with whatprovides, as some packages are provided by others with a different name
+		for _, p := range packages {
+			out, err := CommandOutput(s, "rpm", []string{"-q", "--whatprovides", "--qf", "%{VERSION}-%{RELEASE}\n", p}, l)
+			if err != nil {
+				continue
+			}
+			installed[p] = strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+		}
+	case PacmanInstaller:
+		// pacman exits with error if any package is not installed, but still prints the installed ones
+		out, _ := CommandOutput(s, "pacman", append([]string{"-Q"}, packages...), l)
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && slices.Contains(packages, fields[0]) {
+				installed[fields[0]] = fields[1]
+			}
+		}
+	case AlpineInstaller:
+		// apk prints name-version which cannot be split reliably, so read its database directly
+		db, err := os.ReadFile(s.RootPath("/lib/apk/db/installed"))
+		if err != nil {
+			return installed, err
+		}
+		var name string
+		for _, line := range strings.Split(string(db), "\n") {
+			switch {
+			case strings.HasPrefix(line, "P:"):
+				name = strings.TrimPrefix(line, "P:")
+			case strings.HasPrefix(line, "V:") && slices.Contains(packages, name):
+				installed[name] = strings.TrimPrefix(line, "V:")
+			}
+		}
+	default:
+		return installed, fmt.Errorf("unknown installer %s", i)
 	}
-	return nil
+	l.Logger.Debug().Interface("installed", installed).Msg("Queried installed packages")
+	return installed, nil
 }
@@ -1,69 +1,138 @@
 package features
 
 import (
+	"cmp"
+	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"maps"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// releaseFile is where the kairos release information is stored
+const releaseFile = "/etc/kairos-release"
+
 // KairosRelease implements the Feature interface.
 // it fills the /etc/kairos-release file with the release version and such
-type KairosRelease struct {
-	Order int
-}
+type KairosRelease struct{}
 
-func (g KairosRelease) GetOrder() int {
-	return g.Order
+// Dependencies returns the features that must be installed before the KairosRelease feature.
+func (k KairosRelease) Dependencies() []string {
+	return []string{}
 }
 
 func (k KairosRelease) Install(system values.System, logger sdkTypes.KairosLogger) error {
-	// TODO: read from the current running os-release file to fill some of this fields
-	// KAIROS_FLAVOR_RELEASE
-	// TODO: Add missing stuff and check which ones do we really need?
-	// TODO: Some inputs may be required to fill this file like k3s VS standard or the model?
-	// KAIROS_ID="kairos"
-	// KAIROS_IMAGE_LABEL="24.04-standard-amd64-generic-v3.2.3-4-gae5349e"
-	// KAIROS_VARIANT="standard"
-	// KAIROS_RELEASE="v3.2.3-4-gae5349e"
-	// KAIROS_SOFTWARE_VERSION_PREFIX="k3s"
-	// KAIROS_NAME="kairos-standard-ubuntu-24.04"
-	// KAIROS_VERSION="v3.2.3-4-gae5349e"
-	// KAIROS_ID_LIKE="kairos-standard-ubuntu-24.04"
-	// KAIROS_FLAVOR_RELEASE="24.04"
-	// KAIROS_REGISTRY_AND_ORG="quay.io/kairos"
-	// KAIROS_GITHUB_REPO="kairos-io/kairos"
-	// KAIROS_IMAGE_REPO="quay.io/kairos/ubuntu:24.04-standard-amd64-generic-v3.2.3-4-gae5349e"
-	// KAIROS_ARTIFACT="kairos-ubuntu-24.04-standard-amd64-generic-v3.2.3-4-gae5349e"
-	//
-	// KAIROS_TARGETARCH="amd64"
-	// KAIROS_BUG_REPORT_URL="https://github.com/kairos-io/kairos/issues"
-	// KAIROS_HOME_URL="https://github.com/kairos-io/kairos"
-	// KAIROS_VERSION_ID="v3.2.3-4-gae5349e"
-	// KAIROS_PRETTY_NAME="kairos-standard-ubuntu-24.04 v3.2.3-4-gae5349e"
-	releaseInfo := map[string]string{
-		"KAIROS_VERSION": system.Version,
-		"KAIROS_ARCH":    system.Arch.String(),
-		"KAIROS_FLAVOR":  system.Distro.String(),
-		"KAIROS_FAMILY":  system.Family.String(),
-		"KAIROS_MODEL":   "generic", // NEEDED or it breaks boot!
-		"KAIROS_VARIANT": "core",    // Maybe needed?
-		"TEST":           "HALLO",
-	}
-	return godotenv.Write(releaseInfo, "/etc/kairos-release")
+	releaseInfo, err := k.releaseInfo(system, logger)
+	if err != nil {
+		return err
+	}
+	m, err := LoadManifest(system, k.Name())
+	if err != nil {
+		return err
+	}
+	// Replace the keys from previous runs, keeping only the ones Immutability records for the framework
+	if err = replaceReleaseKeys(system, releaseInfo, frameworkReleaseKeys, logger); err != nil {
+		return err
+	}
+	if err = m.AddFile(system, releaseFile); err != nil {
+		return err
+	}
+	return m.Write(system, logger)
+}
+
+// releaseInfo generates the release keys from the user inputs and the system, using the same naming scheme as
+// the Kairos images. For example, for ubuntu 24.04 with the default inputs:
+//
+//	KAIROS_NAME="kairos-core-ubuntu-24.04"
+//	KAIROS_IMAGE_LABEL="24.04-core-amd64-generic-v3.2.3"
+//	KAIROS_IMAGE_REPO="quay.io/kairos/ubuntu:24.04-core-amd64-generic-v3.2.3"
+//	KAIROS_ARTIFACT="kairos-ubuntu-24.04-core-amd64-generic-v3.2.3"
+//
+// When a k8s provider is set, its name and version are appended to the label and artifact, like "-k3sv1.31.1-k3s1"
+func (k KairosRelease) releaseInfo(system values.System, logger sdkTypes.KairosLogger) (map[string]string, error) {
+	release := system.Release
+	release.Variant = cmp.Or(release.Variant, values.DefaultVariant)
+	if release.K8sProvider != "" {
+		// Images with a k8s provider are standard ones by definition
+		release.Variant = values.StandardVariant
+	}
+	release.Model = cmp.Or(release.Model, values.DefaultModel)
+	release.Registry = cmp.Or(release.Registry, values.DefaultRegistry)
+	if release.Version == "" {
+		logger.Logger.Warn().Str("version", values.DefaultVersion).Msg("No kairos version set, using the default one. Set it so upgrades can be tracked.")
+		release.Version = values.DefaultVersion
+	}
+
+	osRelease, err := godotenv.Read(system.RootPath("/etc/os-release"))
+	if err != nil {
+		return nil, fmt.Errorf("reading os-release: %w", err)
+	}
+	flavor := system.Distro.String()
+	// Rolling distros have no version, so use their build id instead
+	flavorRelease := cmp.Or(system.Version, osRelease["VERSION_ID"], osRelease["BUILD_ID"], "latest")
+	arch := system.Arch.String()
+
+	name := fmt.Sprintf("kairos-%s-%s-%s", release.Variant, flavor, flavorRelease)
+	label := fmt.Sprintf("%s-%s-%s-%s-%s", flavorRelease, release.Variant, arch, release.Model, release.Version)
+	if release.K8sProvider != "" {
+		label += k8sLabelSuffix(release.K8sProvider, release.K8sVersion)
+	}
+
+	info := map[string]string{
+		"KAIROS_ID":               "kairos",
+		"KAIROS_NAME":             name,
+		"KAIROS_ID_LIKE":          name,
+		"KAIROS_PRETTY_NAME":      fmt.Sprintf("%s %s", name, release.Version),
+		"KAIROS_VERSION":          release.Version,
+		"KAIROS_VERSION_ID":       release.Version,
+		"KAIROS_RELEASE":          release.Version,
+		"KAIROS_VARIANT":          release.Variant,
+		"KAIROS_MODEL":            release.Model, // NEEDED or it breaks boot!
+		"KAIROS_FLAVOR":           flavor,
+		"KAIROS_FLAVOR_RELEASE":   flavorRelease,
+		"KAIROS_FAMILY":           system.Family.String(),
+		"KAIROS_ARCH":             arch,
+		"KAIROS_TARGETARCH":       arch,
+		"KAIROS_IMAGE_LABEL":      label,
+		"KAIROS_REGISTRY_AND_ORG": release.Registry,
+		"KAIROS_IMAGE_REPO":       fmt.Sprintf("%s/%s:%s", release.Registry, flavor, label),
+		"KAIROS_ARTIFACT":         fmt.Sprintf("kairos-%s-%s", flavor, label),
+		"KAIROS_GITHUB_REPO":      "kairos-io/kairos",
+		"KAIROS_HOME_URL":         "https://github.com/kairos-io/kairos",
+		"KAIROS_BUG_REPORT_URL":   "https://github.com/kairos-io/kairos/issues",
+	}
+	if release.K8sProvider != "" {
+		info["KAIROS_SOFTWARE_VERSION_PREFIX"] = release.K8sProvider
+		info["KAIROS_SOFTWARE_VERSION"] = release.K8sVersion
+	}
+	return info, nil
+}
+
+// k8sVersionTag returns the k8s version as used on image tags.
+// Tags cannot contain +, which is used in versions like v1.31.1+k3s1
+func k8sVersionTag(version string) string {
+	return strings.ReplaceAll(version, "+", "-")
+}
+
+// k8sLabelSuffix returns what the k8s provider appends to the image label, like "-k3sv1.31.1-k3s1"
+func k8sLabelSuffix(provider, version string) string {
+	return fmt.Sprintf("-%s%s", provider, k8sVersionTag(version))
 }
 
 func (k KairosRelease) Remove(system values.System, logger sdkTypes.KairosLogger) error {
-	return os.Remove("/etc/kairos-release")
+	return removeFromManifest(system, k.Name(), logger)
 }
 
 func (k KairosRelease) Info(system values.System, logger sdkTypes.KairosLogger) {
-	logger.Info("Kernel feature.")
+	logger.Info("KairosRelease feature. Generates the /etc/kairos-release file from the os-release and the release inputs.")
 }
 
 func (k KairosRelease) Installed(system values.System, logger sdkTypes.KairosLogger) bool {
-	_, err := os.Stat("/etc/kairos-release")
-	return err == nil
+	return manifestInstalled(system, k.Name())
 }
 
 func (k KairosRelease) HasServices() bool {
@@ -77,3 +146,93 @@ func (k KairosRelease) InstallsPackages() bool {
 func (k KairosRelease) Name() string {
 	return "KairosRelease"
 }
+
+// readRelease reads the release file from the system. A missing file is returned as empty
+func readRelease(s values.System) (map[string]string, error) {
+	release, err := godotenv.Read(s.RootPath(releaseFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	return release, err
+}
+
+// writeReleaseKeys merges the given keys into the release file, keeping the ones already there
+func writeReleaseKeys(s values.System, keys map[string]string, l sdkTypes.KairosLogger) error {
+	if s.DryRun() {
+		s.Plan.AddCreated(s.RootPath(releaseFile))
+		return nil
+	}
+	release, err := readRelease(s)
+	if err != nil {
+		return err
+	}
+	maps.Copy(release, keys)
+	if err = os.MkdirAll(filepath.Dir(s.RootPath(releaseFile)), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	l.Logger.Debug().Interface("keys", keys).Msg("Writing release keys")
+	return godotenv.Write(release, s.RootPath(releaseFile))
+}
+
+// replaceReleaseKeys writes the given keys as the release file, keeping only the existing keys listed in keep
+func replaceReleaseKeys(s values.System, keys map[string]string, keep []string, l sdkTypes.KairosLogger) error {
+	if s.DryRun() {
+		s.Plan.AddCreated(s.RootPath(releaseFile))
+		return nil
+	}
+	existing, err := readRelease(s)
+	if err != nil {
+		return err
+	}
+	release := maps.Clone(keys)
+	for _, key := range keep {
+		if value, ok := existing[key]; ok {
+			release[key] = value
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(s.RootPath(releaseFile)), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	l.Logger.Debug().Interface("keys", release).Msg("Writing release file")
+	return godotenv.Write(release, s.RootPath(releaseFile))
+}
+
+// removeReleaseKeys removes the given keys from the release file, if it exists
+func removeReleaseKeys(s values.System, keys []string, l sdkTypes.KairosLogger) error {
+	if _, err := os.Stat(s.RootPath(releaseFile)); err != nil {
+		return nil
+	}
+	if s.DryRun() {
+		s.Plan.AddCreated(s.RootPath(releaseFile))
+		return nil
+	}
+	release, err := readRelease(s)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(release, key)
+	}
+	l.Logger.Debug().Strs("keys", keys).Msg("Removing release keys")
+	return godotenv.Write(release, s.RootPath(releaseFile))
+}
+
+// Checks returns the checks for the KairosRelease feature.
+// The release file is validated against the releaseSchema
+func (k KairosRelease) Checks(system values.System, logger sdkTypes.KairosLogger) []values.Check {
+	// Each check reads the file again, so they report on their own if it is missing or cannot be parsed
+	withRelease := func(check func(map[string]string) error) func() error {
+		return func() error {
+			release, err := godotenv.Read(system.RootPath(releaseFile))
+			if err != nil {
+				return err
+			}
+			return check(release)
+		}
+	}
+	return []values.Check{
+		{Name: "release keys", Fn: withRelease(missingReleaseKeys)},
+		{Name: "release values", Fn: withRelease(invalidReleaseValues)},
+		{Name: "unknown release keys", Fn: withRelease(unknownReleaseKeys)},
+	}
+}
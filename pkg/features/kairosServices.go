@@ -1,22 +1,21 @@
 package features
 
 import (
-	"context"
-	"github.com/coreos/go-systemd/v22/dbus"
+	"errors"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
 
-// Implement the Kairos services feature that installs required services in the system
+// Implement the Kairos services feature that enables, disables and masks the services for the system
 // It implements the Feature interface.
 
 // KairosServices represents the KairosServices feature.
-type KairosServices struct {
-	Order int
-}
+type KairosServices struct{}
 
-func (g KairosServices) GetOrder() int {
-	return g.Order
+// Dependencies returns the features that must be installed before the KairosServices feature.
+// The framework ships some of the units
+func (g KairosServices) Dependencies() []string {
+	return []string{"immutability"}
 }
 
 func (g KairosServices) Name() string {
@@ -24,39 +23,83 @@ func (g KairosServices) Name() string {
 }
 
 // Install installs the KairosServices feature.
+// The services for the system are taken from the services map, see values.ServicesMap
 func (g KairosServices) Install(s values.System, l sdkTypes.KairosLogger) error {
-	conn, err := dbus.NewWithContext(context.Background())
+	m, err := LoadManifest(s, g.Name())
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	services := s.Services()
+	l.Logger.Debug().Str("init", s.InitSystem().String()).Interface("services", services).Msg("Applying services")
 
-	servicesNames := []string{
-		"systemd-pcrlock-make-policy",
+	switch s.InitSystem() {
+	case values.OpenRC:
+		err = g.applyOpenRC(s, services, m, l)
+	default:
+		err = g.applySystemd(s, services, m, l)
 	}
-
-	// TODO: return the error?
-	// Disable the service
-	_, err = conn.DisableUnitFilesContext(context.Background(), servicesNames, false)
 	if err != nil {
-		l.Logger.Error().Err(err).Msg("Disabling services")
+		l.Logger.Error().Err(err).Msg("Error applying services.")
+		return err
 	}
-	// Mask the service
-	_, err = conn.MaskUnitFilesContext(context.Background(), servicesNames, false, true)
-	if err != nil {
-		l.Logger.Error().Err(err).Msg("Masking services")
+	return m.Write(s, l)
+}
+
+func (g KairosServices) applySystemd(s values.System, services values.Services, m *Manifest, l sdkTypes.KairosLogger) error {
+	for _, unit := range services.Disable {
+		if err := disableSystemdUnit(s, unit, m, l); err != nil {
+			return err
+		}
+	}
+	for _, unit := range services.Mask {
+		if err := maskSystemdUnit(s, unit, m, l); err != nil {
+			return err
+		}
+	}
+	for _, unit := range services.Enable {
+		if err := enableSystemdUnit(s, unit, m, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g KairosServices) applyOpenRC(s values.System, services values.Services, m *Manifest, l sdkTypes.KairosLogger) error {
+	for _, service := range services.Disable {
+		if err := disableOpenRCService(s, service, m, l); err != nil {
+			return err
+		}
+	}
+	// openrc has no masking, the closest thing is to not have the service on any runlevel
+	for _, service := range services.Mask {
+		l.Logger.Warn().Str("service", service).Msg("openrc cannot mask services, disabling it instead.")
+		if err := disableOpenRCService(s, service, m, l); err != nil {
+			return err
+		}
+	}
+	for _, service := range services.Enable {
+		if err := enableOpenRCService(s, service, m, l); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // Remove removes the KairosServices feature.
+// The links created when enabling or masking are removed. Links removed when disabling are not restored
 func (g KairosServices) Remove(s values.System, l sdkTypes.KairosLogger) error {
-	return nil
+	return removeFromManifest(s, g.Name(), l)
 }
 
 // Info logs information about the KairosServices feature.
 func (g KairosServices) Info(s values.System, l sdkTypes.KairosLogger) {
-	l.Info("Kairos Services feature.")
+	services := s.Services()
+	l.Logger.Info().
+		Str("init", s.InitSystem().String()).
+		Strs("enable", services.Enable).
+		Strs("disable", services.Disable).
+		Strs("mask", services.Mask).
+		Msg("Kairos Services feature. Enables, disables and masks the services needed for a Kairos system.")
 }
 
 // HasServices returns true if the KairosServices feature has services.
@@ -71,11 +114,29 @@ func (g KairosServices) InstallsPackages() bool {
 
 // Installed returns true if the KairosServices feature is installed.
 func (g KairosServices) Installed(s values.System, l sdkTypes.KairosLogger) bool {
-	return true
+	return manifestInstalled(s, g.Name())
 }
 
-type EnableUnitFileChange struct {
-	Type        string // Type of the change (one of symlink or unlink)
-	Filename    string // File name of the symlink
-	Destination string // Destination of the symlink
+// Checks returns the checks for the KairosServices feature.
+func (g KairosServices) Checks(s values.System, l sdkTypes.KairosLogger) []values.Check {
+	services := s.Services()
+	checkEnabled, checkDisabled, checkMasked := systemdUnitEnabled, systemdUnitDisabled, systemdUnitMasked
+	if s.InitSystem() == values.OpenRC {
+		// openrc has no masking, masked services are disabled instead
+		checkEnabled, checkDisabled, checkMasked = openRCServiceEnabled, openRCServiceDisabled, openRCServiceDisabled
+	}
+	return []values.Check{
+		{Name: "enabled services", Fn: func() error { return checkServices(s, services.Enable, checkEnabled) }},
+		{Name: "disabled services", Fn: func() error { return checkServices(s, services.Disable, checkDisabled) }},
+		{Name: "masked services", Fn: func() error { return checkServices(s, services.Mask, checkMasked) }},
+	}
+}
+
+// checkServices runs the check for each service, returning all the failures
+func checkServices(s values.System, services []string, check func(values.System, string) error) error {
+	var errs []error
+	for _, service := range services {
+		errs = append(errs, check(s, service))
+	}
+	return errors.Join(errs...)
 }
@@ -1,73 +1,200 @@
-// File: packages.go
+// File: kernel.go
 
 package features
 
 import (
+	"fmt"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // Kernel represents the Kernel feature.
 // This just links the latest kernel to /boot/vmlinuz
-type Kernel struct {
-	Order int
-}
+type Kernel struct{}
 
-func (g Kernel) GetOrder() int {
-	return g.Order
+// Dependencies returns the features that must be installed before the Kernel feature.
+// The kernel is installed by the Immutability packages
+func (g Kernel) Dependencies() []string {
+	return []string{"immutability"}
 }
 
 func (g Kernel) Name() string {
 	return "Kernel"
 }
 
-// Install installs the Immutability feature.
+// kernelLink is where the kernel in use is linked, so the rest of the tooling does not need to know its version
+const kernelLink = "/boot/vmlinuz"
+
+// kernelImageCandidates returns the paths where the kernel image for the version can be, in order of preference.
+// Each distro family ships it in a different place
+func kernelImageCandidates(s values.System, version string) []string {
+	boot := "/boot/vmlinuz-" + version
+	modules := []string{
+		filepath.Join("/usr/lib/modules", version, "vmlinuz"),
+		filepath.Join("/lib/modules", version, "vmlinuz"),
+	}
+	switch s.Family {
+	case values.RedHatFamily, values.ArchFamily:
+		// The kernel lives with its modules, /boot is only populated by kernel-install or mkinitcpio
+		return append(modules, boot)
+	case values.AlpineFamily:
+		// Alpine names the kernel after its flavor, like /boot/vmlinuz-lts for 6.6.14-0-lts
+		flavor := version[strings.LastIndex(version, "-")+1:]
+		return append([]string{"/boot/vmlinuz-" + flavor, boot}, modules...)
+	default:
+		candidates := []string{boot}
+		// Some arm64 kernels are shipped uncompressed as Image
+		if s.Arch == values.ArchARM64 {
+			candidates = append(candidates, "/boot/Image-"+version)
+		}
+		return append(candidates, modules...)
+	}
+}
+
+// findKernelImage returns the path of the kernel image for the version
+func findKernelImage(s values.System, version string) (string, error) {
+	candidates := kernelImageCandidates(s, version)
+	for _, path := range candidates {
+		if info, err := os.Stat(s.RootPath(path)); err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("kernel image for %s not found in %s", version, strings.Join(candidates, ", "))
+}
+
+// linkedKernelImage returns the path of the kernel image linked from /boot/vmlinuz, absolute inside the system root
+func linkedKernelImage(s values.System) (string, error) {
+	target, err := os.Readlink(s.RootPath(kernelLink))
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(kernelLink), target)
+	}
+	return filepath.Clean(target), nil
+}
+
+// linkedKernelVersion returns the version of the kernel linked from /boot/vmlinuz
+func linkedKernelVersion(s values.System) (string, error) {
+	target, err := os.Readlink(s.RootPath(kernelLink))
+	if err != nil {
+		return "", err
+	}
+	// Either /usr/lib/modules/<version>/vmlinuz or /boot/vmlinuz-<version>
+	if filepath.Base(target) == "vmlinuz" {
+		return filepath.Base(filepath.Dir(target)), nil
+	}
+	return strings.TrimPrefix(filepath.Base(target), "vmlinuz-"), nil
+}
+
+// Install installs the Kernel feature.
+// It links the kernel image to /boot/vmlinuz with a relative link, so it is valid from inside and outside the root
 func (g Kernel) Install(s values.System, l sdkTypes.KairosLogger) error {
-	kernelVersion, err := GetLatestKernel(l)
+	kernelVersion, err := GetKernelVersion(s, l)
 	if err != nil {
-		l.Logger.Error().Err(err).Msgf("Failed to get the latest kernel version: %s", err)
-		return err
+		if !s.DryRun() {
+			l.Logger.Error().Err(err).Msgf("Failed to get the latest kernel version: %s", err)
+			return err
+		}
+		// On dry-run the kernel is probably not installed yet as the packages were not installed
+		l.Logger.Warn().Err(err).Msg("No kernel found, using a placeholder for the dry-run")
+		kernelVersion = dryRunKernelVersion
 	}
-	err = CommandToLogger("depmod", []string{"-a", kernelVersion}, l)
+	err = RunCommand(s, "depmod", []string{"-a", kernelVersion}, l)
 	if err != nil {
 		l.Logger.Error().Err(err).Msgf("Failed to run depmod: %s", err)
 		return err
 	}
-	err = os.Link("/boot/vmlinuz-"+kernelVersion, "/boot/vmlinuz")
+
+	image, err := findKernelImage(s, kernelVersion)
 	if err != nil {
+		if !s.DryRun() {
+			l.Logger.Error().Err(err).Msg("Failed to find the kernel image")
+			return err
+		}
+		image = kernelImageCandidates(s, kernelVersion)[0]
+	}
+	target, err := filepath.Rel(filepath.Dir(kernelLink), image)
+	if err != nil {
+		return err
+	}
+
+	// Older versions left a hard link, which needs to go before linking it
+	if info, err := os.Lstat(s.RootPath(kernelLink)); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		l.Logger.Warn().Str("file", kernelLink).Msg("Kernel is not a link, replacing it.")
+		if err = removePath(s, s.RootPath(kernelLink), l); err != nil {
+			return err
+		}
+	}
+	// Stale links pointing to another kernel are replaced
+	if _, err = createLink(s, target, s.RootPath(kernelLink), l); err != nil {
 		l.Logger.Error().Err(err).Msgf("Failed to link the kernel file: %s", err)
 		return err
 	}
-	return nil
+	l.Logger.Info().Str("kernel", image).Str("version", kernelVersion).Msg("Linked kernel")
+
+	m, err := LoadManifest(s, g.Name())
+	if err != nil {
+		return err
+	}
+	if err = m.AddFile(s, kernelLink); err != nil {
+		return err
+	}
+	return m.Write(s, l)
 }
 
-// Remove removes the Immutability feature.
+// Remove removes the Kernel feature.
+// Only the link is removed, the kernel itself belongs to the kernel package
 func (g Kernel) Remove(s values.System, l sdkTypes.KairosLogger) error {
-	return nil
+	return removeFromManifest(s, g.Name(), l)
 }
 
-// Info logs information about the Immutability feature.
+// Info logs information about the Kernel feature.
 func (g Kernel) Info(s values.System, l sdkTypes.KairosLogger) {
-	l.Info("Kernel feature.")
+	l.Info("Kernel feature. This links the kernel in use to /boot/vmlinuz")
 }
 
-// HasServices returns true if the Immutability feature has services.
+// HasServices returns true if the Kernel feature has services.
 func (g Kernel) HasServices() bool {
 	return false
 }
 
-// InstallsPackages returns true if the Immutability feature installs packages.
+// InstallsPackages returns true if the Kernel feature installs packages.
 func (g Kernel) InstallsPackages() bool {
 	return true
 }
 
-// Installed returns true if the Immutability feature is installed.
+// Installed returns true if the Kernel feature is installed and /boot/vmlinuz links the kernel that would be linked
+// now. A kernel installed or selected after the link was made leaves it stale, so the feature has to run again
 func (g Kernel) Installed(s values.System, l sdkTypes.KairosLogger) bool {
-	// Check if the kernel file exists
-	if _, err := os.Stat("/boot/vmlinuz"); err == nil {
-		l.Logger.Debug().Msg("Kernel is already linked")
-		return true
+	if !manifestInstalled(s, g.Name()) {
+		return false
+	}
+	kernelVersion, err := GetKernelVersion(s, l)
+	if err != nil {
+		l.Logger.Debug().Err(err).Msg("Cannot get the kernel version to check the link")
+		return false
+	}
+	image, err := findKernelImage(s, kernelVersion)
+	if err != nil {
+		l.Logger.Debug().Err(err).Msg("Cannot find the kernel image to check the link")
+		return false
+	}
+	linked, err := linkedKernelImage(s)
+	if err != nil || linked != image {
+		l.Logger.Debug().Str("linked", linked).Str("kernel", image).Msg("Kernel link is stale")
+		return false
+	}
+	l.Logger.Debug().Msg("Kernel is already linked")
+	return true
+}
+
+// Checks returns the checks for the Kernel feature.
+func (g Kernel) Checks(s values.System, l sdkTypes.KairosLogger) []values.Check {
+	return []values.Check{
+		{Name: "kernel link", Fn: func() error { return checkLink(s, kernelLink) }},
 	}
-	return false
 }
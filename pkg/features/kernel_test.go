@@ -0,0 +1,111 @@
+package features
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestKernelInstalled(t *testing.T) {
+	tests := []struct {
+		name      string
+		family    values.Family
+		kernels   []string
+		images    []string
+		link      string
+		manifest  bool
+		installed bool
+	}{
+		{
+			name:      "linked",
+			family:    values.DebianFamily,
+			kernels:   []string{"6.1.0-9-amd64"},
+			images:    []string{"/boot/vmlinuz-6.1.0-9-amd64"},
+			link:      "vmlinuz-6.1.0-9-amd64",
+			manifest:  true,
+			installed: true,
+		},
+		{
+			name:     "not in the manifest",
+			family:   values.DebianFamily,
+			kernels:  []string{"6.1.0-9-amd64"},
+			images:   []string{"/boot/vmlinuz-6.1.0-9-amd64"},
+			link:     "vmlinuz-6.1.0-9-amd64",
+			manifest: false,
+		},
+		{
+			name:     "newer kernel installed",
+			family:   values.DebianFamily,
+			kernels:  []string{"6.1.0-9-amd64", "6.1.0-18-amd64"},
+			images:   []string{"/boot/vmlinuz-6.1.0-9-amd64", "/boot/vmlinuz-6.1.0-18-amd64"},
+			link:     "vmlinuz-6.1.0-9-amd64",
+			manifest: true,
+		},
+		{
+			name:     "not linked",
+			family:   values.DebianFamily,
+			kernels:  []string{"6.1.0-9-amd64"},
+			images:   []string{"/boot/vmlinuz-6.1.0-9-amd64"},
+			manifest: true,
+		},
+		{
+			name:      "modules dir",
+			family:    values.RedHatFamily,
+			kernels:   []string{"5.14.0-362.8.1.el9_3.x86_64"},
+			images:    []string{"/usr/lib/modules/5.14.0-362.8.1.el9_3.x86_64/vmlinuz"},
+			link:      "../usr/lib/modules/5.14.0-362.8.1.el9_3.x86_64/vmlinuz",
+			manifest:  true,
+			installed: true,
+		},
+		{
+			// Alpine names the image after the flavor, not the version
+			name:      "alpine flavor",
+			family:    values.AlpineFamily,
+			kernels:   []string{"6.6.14-0-lts"},
+			images:    []string{"/boot/vmlinuz-lts"},
+			link:      "vmlinuz-lts",
+			manifest:  true,
+			installed: true,
+		},
+		{
+			name:      "absolute link",
+			family:    values.DebianFamily,
+			kernels:   []string{"6.1.0-9-amd64"},
+			images:    []string{"/boot/vmlinuz-6.1.0-9-amd64"},
+			link:      "/boot/vmlinuz-6.1.0-9-amd64",
+			manifest:  true,
+			installed: true,
+		},
+	}
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := values.System{Root: t.TempDir(), Family: tt.family, Arch: values.ArchAMD64}
+			for _, k := range tt.kernels {
+				if err := os.MkdirAll(s.RootPath(filepath.Join("/lib/modules", k)), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, image := range tt.images {
+				writeTestFile(t, s.Root, image, "kernel")
+			}
+			if err := os.MkdirAll(s.RootPath("/boot"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.link != "" {
+				if err := os.Symlink(tt.link, s.RootPath(kernelLink)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.manifest {
+				writeTestFile(t, s.Root, filepath.Join(values.ManifestDir, "kernel.json"), "{}")
+			}
+			if installed := (Kernel{}).Installed(s, l); installed != tt.installed {
+				t.Errorf("Installed() = %t, want %t", installed, tt.installed)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package features
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Kubernetes represents the Kubernetes feature.
+// It installs the k8s provider binary and its services, making the image a standard variant.
+// The services are not enabled, as the provider is configured and started on first boot by the kairos agent
+type Kubernetes struct{}
+
+// k8sService is a service shipped for a k8s provider
+type k8sService struct {
+	Name        string
+	Description string
+	Args        string
+}
+
+// k8sProvider describes how to install each k8s provider
+type k8sProvider struct {
+	image    string   // Default image to get the binary from, the version is used as tag
+	binary   string   // Path of the binary inside the image
+	links    []string // Extra tools provided by the same binary
+	services []k8sService
+}
+
+// k8sBinaryDir is where the k8s provider binary and its links are installed
+const k8sBinaryDir = "/usr/bin"
+
+var k8sProviders = map[string]k8sProvider{
+	values.K3sProvider: {
+		image:  "docker.io/rancher/k3s",
+		binary: "/bin/k3s",
+		links:  []string{"kubectl", "crictl", "ctr"},
+		services: []k8sService{
+			{Name: "k3s", Description: "Lightweight Kubernetes", Args: "server"},
+			{Name: "k3s-agent", Description: "Lightweight Kubernetes Agent", Args: "agent"},
+		},
+	},
+	values.K0sProvider: {
+		image:  "docker.io/k0sproject/k0s",
+		binary: "/usr/local/bin/k0s",
+		services: []k8sService{
+			{Name: "k0scontroller", Description: "k0s - Zero Friction Kubernetes Controller", Args: "controller"},
+			{Name: "k0sworker", Description: "k0s - Zero Friction Kubernetes Worker", Args: "worker"},
+		},
+	},
+}
+
+var systemdK8sUnit = template.Must(template.New("systemd").Parse(`[Unit]
+Description={{.Description}}
+Wants=network-online.target
+After=network-online.target
+
+[Install]
+WantedBy=multi-user.target
+
+[Service]
+Type=notify
+EnvironmentFile=-/etc/default/%N
+EnvironmentFile=-/etc/sysconfig/%N
+KillMode=process
+Delegate=yes
+LimitNOFILE=1048576
+LimitNPROC=infinity
+LimitCORE=infinity
+TasksMax=infinity
+TimeoutStartSec=0
+Restart=always
+RestartSec=5s
+ExecStartPre=-/sbin/modprobe br_netfilter
+ExecStartPre=-/sbin/modprobe overlay
+ExecStart={{.Binary}} {{.Args}}
+`))
+
+var openrcK8sService = template.Must(template.New("openrc").Parse(`#!/sbin/openrc-run
+
+description="{{.Description}}"
+supervisor=supervise-daemon
+command="{{.Binary}}"
+command_args="{{.Args}}"
+output_log=/var/log/{{.Name}}.log
+error_log=/var/log/{{.Name}}.log
+pidfile="/var/run/{{.Name}}.pid"
+respawn_delay=5
+respawn_max=0
+
+depend() {
+	after network-online
+	want cgroups
+}
+
+set -o allexport
+if [ -f /etc/environment ]; then . /etc/environment; fi
+set +o allexport
+`))
+
+// Dependencies returns the features that must be installed before the Kubernetes feature.
+// It writes its keys on top of the release file
+func (k Kubernetes) Dependencies() []string {
+	return []string{"release"}
+}
+
+func (k Kubernetes) Name() string {
+	return "Kubernetes"
+}
+
+// Install installs the Kubernetes feature.
+func (k Kubernetes) Install(s values.System, l sdkTypes.KairosLogger) error {
+	providerName := s.Release.K8sProvider
+	if providerName == "" {
+		l.Logger.Info().Msg("No k8s provider set, nothing to install.")
+		return nil
+	}
+	provider, ok := k8sProviders[providerName]
+	if !ok {
+		return fmt.Errorf("unknown k8s provider %s", providerName)
+	}
+	source := s.K8sSource
+	if source == "" {
+		if s.Release.K8sVersion == "" {
+			return fmt.Errorf("a k8s version or source is needed to install %s", providerName)
+		}
+		source = fmt.Sprintf("%s:%s", provider.image, k8sVersionTag(s.Release.K8sVersion))
+	}
+
+	m, err := LoadManifest(s, k.Name())
+	if err != nil {
+		return err
+	}
+	binary := filepath.Join(k8sBinaryDir, providerName)
+	l.Logger.Info().Str("provider", providerName).Str("source", source).Msg("Installing k8s provider")
+	if err = installK8sBinary(s, source, provider.binary, binary, l); err != nil {
+		l.Logger.Error().Err(err).Str("source", source).Msg("Error installing k8s provider.")
+		return err
+	}
+	if err = m.AddFile(s, binary); err != nil {
+		return err
+	}
+	// The tools sit next to the binary, so they link it by name and do not depend on where the root is mounted
+	for _, link := range provider.links {
+		if err = addLink(s, providerName, filepath.Join(k8sBinaryDir, link), m, l); err != nil {
+			return err
+		}
+	}
+
+	for _, service := range provider.services {
+		path, err := writeK8sService(s, service, binary, l)
+		if err != nil {
+			return err
+		}
+		if err = m.AddFile(s, path); err != nil {
+			return err
+		}
+	}
+
+	keys := map[string]string{
+		"KAIROS_VARIANT":                 values.StandardVariant,
+		"KAIROS_SOFTWARE_VERSION_PREFIX": providerName,
+	}
+	if s.Release.K8sVersion != "" {
+		keys["KAIROS_SOFTWARE_VERSION"] = s.Release.K8sVersion
+	}
+	if err = writeReleaseKeys(s, keys, l); err != nil {
+		return err
+	}
+	return m.Write(s, l)
+}
+
+// installK8sBinary installs the provider binary from the source into dest.
+// The source can be a local binary, or any of the sources supported by openSource, from which the binary is extracted
+func installK8sBinary(s values.System, source, binary, dest string, l sdkTypes.KairosLogger) error {
+	if s.DryRun() {
+		s.Plan.AddImage(source, s.RootPath(dest))
+		return nil
+	}
+	if isELF(source) {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return copyExecutable(f, s.RootPath(dest))
+	}
+
+	reader, _, err := openSource(s, source, l)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("binary %s not found in %s", binary, source)
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Join("/", header.Name) == binary && header.Typeflag == tar.TypeReg {
+			return copyExecutable(tr, s.RootPath(dest))
+		}
+	}
+}
+
+// isELF returns true if the path is a local ELF binary
+func isELF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("\x7fELF"))
+}
+
+// copyExecutable writes the reader contents as an executable file in dest
+func copyExecutable(reader io.Reader, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, reader); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeK8sService writes the service for the init system of the system and returns its path
+func writeK8sService(s values.System, service k8sService, binary string, l sdkTypes.KairosLogger) (string, error) {
+	data := struct {
+		k8sService
+		Binary string
+	}{service, binary}
+
+	tmpl, path, perm := systemdK8sUnit, filepath.Join(systemdConfigDir, service.Name+".service"), os.FileMode(0644)
+	if s.InitSystem() == values.OpenRC {
+		tmpl, path, perm = openrcK8sService, filepath.Join("/etc/init.d", service.Name), os.FileMode(0755)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return path, writeFile(s, s.RootPath(path), buf.Bytes(), perm, l)
+}
+
+// Remove removes the Kubernetes feature.
+func (k Kubernetes) Remove(s values.System, l sdkTypes.KairosLogger) error {
+	if !manifestInstalled(s, k.Name()) {
+		l.Logger.Info().Str("feature", k.Name()).Msg("No manifest found, feature is not installed.")
+		return nil
+	}
+	if _, err := os.Stat(s.RootPath(releaseFile)); err == nil {
+		release, err := readRelease(s)
+		if err != nil {
+			return err
+		}
+		keys := map[string]string{"KAIROS_VARIANT": values.CoreVariant}
+		// The image names get the provider appended by the release, which no longer applies
+		if provider := release["KAIROS_SOFTWARE_VERSION_PREFIX"]; provider != "" {
+			suffix := k8sLabelSuffix(provider, release["KAIROS_SOFTWARE_VERSION"])
+			for _, key := range []string{"KAIROS_IMAGE_LABEL", "KAIROS_IMAGE_REPO", "KAIROS_ARTIFACT"} {
+				if value, ok := release[key]; ok {
+					keys[key] = strings.TrimSuffix(value, suffix)
+				}
+			}
+		}
+		if err = writeReleaseKeys(s, keys, l); err != nil {
+			return err
+		}
+		if err = removeReleaseKeys(s, []string{"KAIROS_SOFTWARE_VERSION_PREFIX", "KAIROS_SOFTWARE_VERSION"}, l); err != nil {
+			return err
+		}
+	}
+	return removeFromManifest(s, k.Name(), l)
+}
+
+// Info logs information about the Kubernetes feature.
+func (k Kubernetes) Info(s values.System, l sdkTypes.KairosLogger) {
+	l.Logger.Info().
+		Str("provider", s.Release.K8sProvider).
+		Str("version", s.Release.K8sVersion).
+		Msg("Kubernetes feature. Installs the k8s provider and its services for the standard variant.")
+}
+
+// HasServices returns true if the Kubernetes feature has services.
+func (k Kubernetes) HasServices() bool {
+	return true
+}
+
+// InstallsPackages returns true if the Kubernetes feature installs packages.
+func (k Kubernetes) InstallsPackages() bool {
+	return false
+}
+
+// Installed returns true if the Kubernetes feature is installed.
+func (k Kubernetes) Installed(s values.System, l sdkTypes.KairosLogger) bool {
+	return manifestInstalled(s, k.Name())
+}
+
+// Checks returns the checks for the Kubernetes feature.
+// Without a k8s provider there is nothing to check
+func (k Kubernetes) Checks(s values.System, l sdkTypes.KairosLogger) []values.Check {
+	providerName := s.Release.K8sProvider
+	provider, ok := k8sProviders[providerName]
+	if !ok {
+		return nil
+	}
+	binary := filepath.Join(k8sBinaryDir, providerName)
+	return []values.Check{
+		{Name: "k8s binary", Fn: func() error {
+			info, err := os.Stat(s.RootPath(binary))
+			if err != nil {
+				return err
+			}
+			if info.Mode()&0111 == 0 {
+				return fmt.Errorf("%s is not executable", binary)
+			}
+			return nil
+		}},
+		{Name: "k8s links", Fn: func() error {
+			var errs []error
+			for _, link := range provider.links {
+				errs = append(errs, checkLink(s, filepath.Join(k8sBinaryDir, link)))
+			}
+			return errors.Join(errs...)
+		}},
+		{Name: "k8s services", Fn: func() error {
+			var errs []error
+			for _, service := range provider.services {
+				path := filepath.Join(systemdConfigDir, service.Name+".service")
+				if s.InitSystem() == values.OpenRC {
+					path = filepath.Join("/etc/init.d", service.Name)
+				}
+				if _, err := os.Stat(s.RootPath(path)); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			return errors.Join(errs...)
+		}},
+	}
+}
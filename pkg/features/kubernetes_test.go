@@ -0,0 +1,81 @@
+package features
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestKubernetesInstallRemove(t *testing.T) {
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	s := testSystem(t)
+	s.Release = values.Release{K8sProvider: values.K3sProvider, K8sVersion: "v1.31.1+k3s1"}
+	s.K8sSource = filepath.Join(t.TempDir(), "k3s")
+	if err := os.WriteFile(s.K8sSource, []byte("\x7fELF"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	label := "24.04-standard-amd64-generic-v3.2.3"
+	suffix := "-k3sv1.31.1-k3s1"
+	release := map[string]string{
+		"KAIROS_VARIANT":     values.StandardVariant,
+		"KAIROS_IMAGE_LABEL": label + suffix,
+		"KAIROS_IMAGE_REPO":  "quay.io/kairos/ubuntu:" + label + suffix,
+		"KAIROS_ARTIFACT":    "kairos-ubuntu-" + label + suffix,
+	}
+	if err := os.MkdirAll(s.RootPath("/etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := godotenv.Write(release, s.RootPath(releaseFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	k := Kubernetes{}
+	if err := k.Install(s, l); err != nil {
+		t.Fatalf("Install() unexpected error: %v", err)
+	}
+	for _, link := range []string{"kubectl", "crictl", "ctr"} {
+		target, err := os.Readlink(s.RootPath(filepath.Join(k8sBinaryDir, link)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != "k3s" {
+			t.Errorf("%s links to %s, want k3s", link, target)
+		}
+	}
+	for _, check := range k.Checks(s, l) {
+		if err := check.Fn(); err != nil {
+			t.Errorf("check %s failed: %v", check.Name, err)
+		}
+	}
+
+	if err := k.Remove(s, l); err != nil {
+		t.Fatalf("Remove() unexpected error: %v", err)
+	}
+	got, err := readRelease(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"KAIROS_VARIANT":     values.CoreVariant,
+		"KAIROS_IMAGE_LABEL": label,
+		"KAIROS_IMAGE_REPO":  "quay.io/kairos/ubuntu:" + label,
+		"KAIROS_ARTIFACT":    "kairos-ubuntu-" + label,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q after removing, want %q", key, got[key], value)
+		}
+	}
+	for _, key := range []string{"KAIROS_SOFTWARE_VERSION_PREFIX", "KAIROS_SOFTWARE_VERSION"} {
+		if _, ok := got[key]; ok {
+			t.Errorf("%s still in the release after removing", key)
+		}
+	}
+	if _, err = os.Lstat(s.RootPath(filepath.Join(k8sBinaryDir, "kubectl"))); err == nil {
+		t.Error("kubectl link still there after removing")
+	}
+}
@@ -0,0 +1,202 @@
+package features
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Manifest is the record of everything a feature changed on the system.
+// It is written once the feature is installed, and used to know if a feature is installed and how to remove it.
+type Manifest struct {
+	Feature   string            `json:"feature"`
+	Installed time.Time         `json:"installed"`
+	Packages  []ManifestPackage `json:"packages,omitempty"` // Packages installed by the feature that were not there before
+	Files     []ManifestFile    `json:"files,omitempty"`    // Files created by the feature
+	Removed   []string          `json:"removed,omitempty"`  // Files removed by the feature, like old kernels
+}
+
+// ManifestPackage is a package installed by a feature
+type ManifestPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// ManifestFile is a file created by a feature. Checksum is only set for regular files and Link only for symlinks
+type ManifestFile struct {
+	Path     string `json:"path"`
+	Checksum string `json:"sha256,omitempty"`
+	Link     string `json:"link,omitempty"`
+}
+
+// NewManifest returns an empty manifest for the given feature
+func NewManifest(feature string) *Manifest {
+	return &Manifest{Feature: feature}
+}
+
+// LoadManifest returns the manifest of the given feature from the system, or an empty one if there is none.
+// Installing a feature again, like with --force, adds to what the previous runs recorded instead of replacing it,
+// as things that are already there are not reported again, like preinstalled packages or existing links
+func LoadManifest(s values.System, feature string) (*Manifest, error) {
+	m, err := ReadManifest(s, feature)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewManifest(feature), nil
+	}
+	return m, err
+}
+
+// manifestPath returns where the manifest for the given feature is stored on the system
+func manifestPath(s values.System, feature string) string {
+	return s.RootPath(filepath.Join(values.ManifestDir, strings.ToLower(feature)+".json"))
+}
+
+// systemPath returns the absolute path inside the system root of a path on the host, as recorded on the manifests
+func systemPath(s values.System, path string) (string, error) {
+	rel, err := filepath.Rel(s.RootPath("/"), path)
+	if err != nil {
+		return "", err
+	}
+	return "/" + rel, nil
+}
+
+// ReadManifest reads the manifest of the given feature from the system
+func ReadManifest(s values.System, feature string) (*Manifest, error) {
+	data, err := os.ReadFile(manifestPath(s, feature))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	err = json.Unmarshal(data, m)
+	return m, err
+}
+
+// manifestInstalled returns true if the feature has a manifest on the system, meaning it was fully installed
+func manifestInstalled(s values.System, feature string) bool {
+	_, err := os.Stat(manifestPath(s, feature))
+	return err == nil
+}
+
+// AddPackage records a package with its version, updating the version if it was already recorded
+func (m *Manifest) AddPackage(name, version string) {
+	i := slices.IndexFunc(m.Packages, func(p ManifestPackage) bool { return p.Name == name })
+	if i != -1 {
+		m.Packages[i].Version = version
+		return
+	}
+	m.Packages = append(m.Packages, ManifestPackage{Name: name, Version: version})
+}
+
+// AddFile records a file created by the feature, path being the absolute path inside the system root.
+// Its checksum or link target is read from the system, so it needs to be called once the file is in place
+func (m *Manifest) AddFile(s values.System, path string) error {
+	f := ManifestFile{Path: path}
+	if s.DryRun() {
+		m.addFile(f)
+		return nil
+	}
+	info, err := os.Lstat(s.RootPath(path))
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		f.Link, err = os.Readlink(s.RootPath(path))
+		if err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		f.Checksum, err = fileChecksum(s.RootPath(path))
+		if err != nil {
+			return err
+		}
+	}
+	m.addFile(f)
+	return nil
+}
+
+// addFile records the file, replacing the previous record for the same path
+func (m *Manifest) addFile(f ManifestFile) {
+	i := slices.IndexFunc(m.Files, func(file ManifestFile) bool { return file.Path == f.Path })
+	if i != -1 {
+		m.Files[i] = f
+		return
+	}
+	m.Files = append(m.Files, f)
+}
+
+// AddRemoved records a file removed by the feature, path being the absolute path inside the system root
+func (m *Manifest) AddRemoved(path string) {
+	if !slices.Contains(m.Removed, path) {
+		m.Removed = append(m.Removed, path)
+	}
+}
+
+// Write stores the manifest on the system, or records it on the plan when running in dry-run mode
+func (m *Manifest) Write(s values.System, l sdkTypes.KairosLogger) error {
+	path := manifestPath(s, m.Feature)
+	if s.DryRun() {
+		s.Plan.AddCreated(path)
+		return nil
+	}
+	m.Installed = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	l.Logger.Debug().Str("feature", m.Feature).Str("manifest", path).Msg("Writing manifest")
+	return os.WriteFile(path, data, 0644)
+}
+
+// RemoveFiles removes the files recorded on the manifest and the manifest itself
+func (m *Manifest) RemoveFiles(s values.System, l sdkTypes.KairosLogger) error {
+	// Remove in reverse, so links are removed before the files they point to
+	files := slices.Clone(m.Files)
+	slices.Reverse(files)
+	for _, f := range files {
+		if err := removePath(s, s.RootPath(f.Path), l); err != nil {
+			l.Logger.Error().Err(err).Str("file", f.Path).Msg("Error removing file.")
+			return err
+		}
+	}
+	return removePath(s, manifestPath(s, m.Feature), l)
+}
+
+// removeFromManifest removes everything the feature recorded on its manifest.
+// If there is no manifest the feature was never installed, so there is nothing to remove
+func removeFromManifest(s values.System, feature string, l sdkTypes.KairosLogger) error {
+	m, err := ReadManifest(s, feature)
+	if errors.Is(err, os.ErrNotExist) {
+		l.Logger.Info().Str("feature", feature).Msg("No manifest found, feature is not installed.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return m.RemoveFiles(s, l)
+}
+
+// fileChecksum returns the sha256 checksum of the file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
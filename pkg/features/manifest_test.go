@@ -0,0 +1,253 @@
+package features
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// fakeInstaller keeps the installed packages in memory
+type fakeInstaller struct {
+	installed map[string]string
+	installs  int
+}
+
+func (i *fakeInstaller) Install(_ values.System, packages []string, _ sdkTypes.KairosLogger) error {
+	i.installs++
+	for _, p := range packages {
+		i.installed[p] = "1.0"
+	}
+	return nil
+}
+
+func (i *fakeInstaller) Remove(_ values.System, packages []string, _ sdkTypes.KairosLogger) error {
+	for _, p := range packages {
+		delete(i.installed, p)
+	}
+	return nil
+}
+
+func (i *fakeInstaller) Query(_ values.System, packages []string, _ sdkTypes.KairosLogger) (map[string]string, error) {
+	found := map[string]string{}
+	for _, p := range packages {
+		if v, ok := i.installed[p]; ok {
+			found[p] = v
+		}
+	}
+	return found, nil
+}
+
+// writeTestFile writes the file under the root, creating its parent dirs
+func writeTestFile(t *testing.T, root, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, path), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// frameworkTarball writes a rootfs tarball with the given files, to be used as the framework source
+func frameworkTarball(t *testing.T, files ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "framework.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, file := range files {
+		if err = tw.WriteHeader(&tar.Header{Name: file, Mode: 0644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testSystem returns an ubuntu system on a new root, with a fake installer and a local framework
+func testSystem(t *testing.T) values.System {
+	t.Helper()
+	root := t.TempDir()
+	// Units for the services enabled on ubuntu
+	for _, unit := range []string{"ssh.service", "systemd-networkd.service"} {
+		writeTestFile(t, root, filepath.Join("/usr/lib/systemd/system", unit), "[Install]\nWantedBy=multi-user.target\n")
+	}
+	return values.System{
+		Root:           root,
+		Distro:         values.Ubuntu,
+		Family:         values.DebianFamily,
+		Version:        "24.04",
+		Arch:           values.ArchAMD64,
+		Installer:      &fakeInstaller{installed: map[string]string{}},
+		FrameworkImage: frameworkTarball(t, "etc/kairos/test.yaml", "usr/bin/test-agent"),
+	}
+}
+
+// manifestPaths returns the package names and file paths recorded on the manifest
+func manifestPaths(t *testing.T, s values.System, feature string) ([]string, []string) {
+	t.Helper()
+	m, err := ReadManifest(s, feature)
+	if err != nil {
+		t.Fatalf("reading %s manifest: %v", feature, err)
+	}
+	var packages, files []string
+	for _, p := range m.Packages {
+		packages = append(packages, p.Name)
+	}
+	for _, f := range m.Files {
+		files = append(files, f.Path)
+	}
+	return packages, files
+}
+
+// TestInstallTwice checks that installing again, like with --force, keeps what the first install recorded, even if
+// the second one finds everything already in place
+func TestInstallTwice(t *testing.T) {
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	tests := []struct {
+		feature values.Feature
+		files   []string
+	}{
+		{Immutability{}, []string{"/etc/kairos/test.yaml", "/usr/bin/test-agent"}},
+		{KairosServices{}, []string{
+			"/etc/systemd/system/systemd-pcrlock-make-policy.service",
+			"/etc/systemd/system/multi-user.target.wants/ssh.service",
+			"/etc/systemd/system/multi-user.target.wants/systemd-networkd.service",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.feature.Name(), func(t *testing.T) {
+			s := testSystem(t)
+			if err := tt.feature.Install(s, l); err != nil {
+				t.Fatalf("first install: %v", err)
+			}
+			firstPackages, firstFiles := manifestPaths(t, s, tt.feature.Name())
+			if err := tt.feature.Install(s, l); err != nil {
+				t.Fatalf("second install: %v", err)
+			}
+			packages, files := manifestPaths(t, s, tt.feature.Name())
+
+			if !slices.Equal(packages, firstPackages) {
+				t.Errorf("packages after the second install = %v, want %v", packages, firstPackages)
+			}
+			if tt.feature.InstallsPackages() && len(packages) == 0 {
+				t.Error("no packages recorded")
+			}
+			if !slices.Equal(files, firstFiles) {
+				t.Errorf("files after the second install = %v, want %v", files, firstFiles)
+			}
+			for _, f := range tt.files {
+				if !slices.Contains(files, f) {
+					t.Errorf("%s not recorded, got %v", f, files)
+				}
+			}
+
+			// Removing has to undo the first install
+			if err := tt.feature.Remove(s, l); err != nil {
+				t.Fatalf("remove: %v", err)
+			}
+			for _, f := range tt.files {
+				if _, err := os.Lstat(s.RootPath(f)); err == nil {
+					t.Errorf("%s still there after removing", f)
+				}
+			}
+			if installed, _ := s.Installer.Query(s, packages, l); len(installed) > 0 {
+				t.Errorf("packages still installed after removing: %v", installed)
+			}
+		})
+	}
+}
+
+// TestApplyFeaturesForce checks that a forced run installs everything again without losing what the previous run
+// recorded, so removing the features afterwards still undoes all of it
+func TestApplyFeaturesForce(t *testing.T) {
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	s := testSystem(t)
+	installer := s.Installer.(*fakeInstaller)
+	if err := s.ResolveFeatures(Features, []string{"services"}, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyFeatures(l); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	packages, files := manifestPaths(t, s, "Immutability")
+	_, links := manifestPaths(t, s, "KairosServices")
+
+	// Without force, the completed features are skipped
+	if err := s.ApplyFeatures(l); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if installer.installs != 1 {
+		t.Errorf("packages installed %d times without force, want 1", installer.installs)
+	}
+
+	s.Force = true
+	if err := s.ApplyFeatures(l); err != nil {
+		t.Fatalf("forced run: %v", err)
+	}
+	if installer.installs != 2 {
+		t.Errorf("packages installed %d times after forcing, want 2", installer.installs)
+	}
+	forcedPackages, forcedFiles := manifestPaths(t, s, "Immutability")
+	_, forcedLinks := manifestPaths(t, s, "KairosServices")
+	if len(packages) == 0 || !slices.Equal(forcedPackages, packages) {
+		t.Errorf("packages after forcing = %v, want %v", forcedPackages, packages)
+	}
+	if !slices.Equal(forcedFiles, files) {
+		t.Errorf("files after forcing = %v, want %v", forcedFiles, files)
+	}
+	if len(links) == 0 || !slices.Equal(forcedLinks, links) {
+		t.Errorf("service links after forcing = %v, want %v", forcedLinks, links)
+	}
+
+	if err := s.RemoveFeatures(l); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if len(installer.installed) > 0 {
+		t.Errorf("packages still installed after removing: %v", installer.installed)
+	}
+	for _, f := range append(files, links...) {
+		if _, err := os.Lstat(s.RootPath(f)); err == nil {
+			t.Errorf("%s still there after removing", f)
+		}
+	}
+}
+
+// TestApplyFeaturesNotInstalled checks that a feature completed on a previous run installs again when it is no
+// longer installed, like the Kernel when a newer kernel leaves its link stale
+func TestApplyFeaturesNotInstalled(t *testing.T) {
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	s := testSystem(t)
+	installer := s.Installer.(*fakeInstaller)
+	if err := s.ResolveFeatures(Features, []string{"services"}, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyFeatures(l); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if err := os.Remove(manifestPath(s, "Immutability")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyFeatures(l); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if installer.installs != 2 {
+		t.Errorf("packages installed %d times, want 2", installer.installs)
+	}
+	if !manifestInstalled(s, "Immutability") {
+		t.Error("Immutability not installed after the second run")
+	}
+}
@@ -0,0 +1,196 @@
+package features
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"slices"
+	"strings"
+)
+
+// ResolvedPackage is a package that matched for a system, with the info about where it came from
+type ResolvedPackage struct {
+	Name       string `json:"name"`
+	Category   string `json:"category"`             // PackageMap category the package came from
+	Constraint string `json:"constraint"`           // VersionMap key that matched the system version
+	FromConfig bool   `json:"fromConfig,omitempty"` // Whether the package was added by the user config
+}
+
+// ResolvePackages returns the packages to install for the given system, already templated.
+// It parses the package maps and returns the packages that match the system version with semver
+// Systems without a semver version (i.e. rolling releases like Arch) only get the Common packages
+func ResolvePackages(s values.System, l sdkTypes.KairosLogger) ([]ResolvedPackage, error) {
+	var resolved []ResolvedPackage
+
+	add := func(category, constraint string, packages []string, fromConfig bool) error {
+		templated, err := values.PackageListToTemplate(packages, s.GetTemplateParams(), l)
+		if err != nil {
+			l.Logger.Error().Err(err).Str("category", category).Msg("Error parsing packages.")
+			return err
+		}
+		for _, p := range templated {
+			resolved = append(resolved, ResolvedPackage{Name: p, Category: category, Constraint: constraint, FromConfig: fromConfig})
+		}
+		return nil
+	}
+
+	// Removals that do not match any package, reported at the end so a typo in the config does not go unnoticed
+	var unmatched []string
+	// overrides merges the user config for the category on top of what was resolved for it
+	overrides := func(category values.PackageCategory, version *semver.Version) error {
+		added := s.PackageOverrides.Add[category][s.Distro][s.Arch]
+		for _, k := range matchingConstraints(added, version, l) {
+			l.Logger.Debug().Str("category", category.String()).Str("constraint", k).Strs("packages", added[k]).Msg("Adding packages from config")
+			if err := add(category.String(), k, added[k], true); err != nil {
+				return err
+			}
+		}
+		removed := s.PackageOverrides.Remove[category][s.Distro][s.Arch]
+		for _, k := range matchingConstraints(removed, version, l) {
+			l.Logger.Debug().Str("category", category.String()).Str("constraint", k).Strs("packages", removed[k]).Msg("Removing packages from config")
+			names, err := values.PackageListToTemplate(removed[k], s.GetTemplateParams(), l)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				before := len(resolved)
+				resolved = slices.DeleteFunc(resolved, func(p ResolvedPackage) bool {
+					return p.Category == category.String() && p.Name == name
+				})
+				if len(resolved) == before {
+					unmatched = append(unmatched, fmt.Sprintf("%s (%s)", name, category))
+				}
+			}
+		}
+		return nil
+	}
+
+	version, err := semver.NewVersion(s.Version)
+	if err != nil {
+		l.Logger.Warn().Err(err).Str("version", s.Version).Msg("Cannot parse version, only common packages will be used.")
+		version = nil
+	}
+
+	if err = add(values.CommonCategory.String(), values.Common, values.CommonPackages, false); err != nil {
+		return resolved, err
+	}
+	if err = overrides(values.CommonCategory, version); err != nil {
+		return resolved, err
+	}
+
+	// Check that we have packages for every category, otherwise we would end up with an incomplete system
+	var names []string
+	for _, c := range values.MissingPackageCategories(s.Distro, s.Arch, s.Version, s.GetBootMode()) {
+		names = append(names, c.String())
+	}
+	if len(names) > 0 {
+		if s.StrictPackages {
+			err = fmt.Errorf("no packages defined for %s %s/%s in categories: %s", s.Distro, s.Version, s.Arch, strings.Join(names, ", "))
+			l.Logger.Error().Err(err).Msg("Missing package categories.")
+			return resolved, err
+		}
+		l.Logger.Warn().Strs("categories", names).Str("distro", s.Distro.String()).Str("version", s.Version).Str("arch", s.Arch.String()).Msg("No packages defined for some categories, the system may be incomplete.")
+	}
+
+	// Go over all packages maps
+	// immucore and grub packages should only be installed under grub
+	// systemd packages should only be installed under trusted boot
+	for _, category := range values.PackageCategories() {
+		if !category.AppliesTo(s.GetBootMode()) {
+			l.Logger.Debug().Str("category", category.String()).Str("boot", s.GetBootMode().String()).Msg("Skipping packages for boot mode")
+			continue
+		}
+		packages := category.PackageMap()[s.Distro][s.Arch]
+		for _, k := range matchingConstraints(packages, version, l) {
+			if err = add(category.String(), k, packages[k], false); err != nil {
+				return resolved, err
+			}
+		}
+
+		// Now merge the user config on top of the package map
+		if err = overrides(category, version); err != nil {
+			return resolved, err
+		}
+	}
+
+	if len(unmatched) > 0 {
+		if s.StrictPackages {
+			err = fmt.Errorf("packages to remove from config not found: %s", strings.Join(unmatched, ", "))
+			l.Logger.Error().Err(err).Msg("Removing packages from config.")
+			return resolved, err
+		}
+		l.Logger.Warn().Strs("packages", unmatched).Msg("Packages to remove from config not found, ignoring them.")
+	}
+
+	return resolved, nil
+}
+
+// matchingConstraints returns the keys of the VersionMap that apply to the given version, with the Common key first.
+// A nil version only matches the Common key
+func matchingConstraints(packages values.VersionMap, version *semver.Version, l sdkTypes.KairosLogger) []string {
+	matching, err := packages.MatchingConstraints(version)
+	if err != nil {
+		l.Logger.Error().Err(err).Msg("Error parsing constraints.")
+	}
+	l.Logger.Debug().Strs("constraints", matching).Msg("Matching constraints")
+	return matching
+}
+
+// getPackages returns the names of the packages to install for the system, already templated
+func getPackages(s values.System, l sdkTypes.KairosLogger) ([]string, error) {
+	resolved, err := ResolvePackages(s, l)
+	if err != nil {
+		return []string{}, err
+	}
+	var packages []string
+	for _, p := range resolved {
+		packages = append(packages, p.Name)
+	}
+	return packages, nil
+}
+
+// checkPackages checks that all the packages resolved for the system are installed, listing the missing ones with
+// where they came from and their expected version. The installed versions are logged, so they can be compared when
+// something fails
+func checkPackages(s values.System, l sdkTypes.KairosLogger) error {
+	if err := s.CheckInstaller(); err != nil {
+		return err
+	}
+	resolved, err := ResolvePackages(s, l)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, p := range resolved {
+		names = append(names, p.Name)
+	}
+	installed, err := s.Installer.Query(s, names, l)
+	if err != nil {
+		return fmt.Errorf("querying installed packages: %w", err)
+	}
+	l.Logger.Info().Interface("packages", installed).Msg("Installed packages")
+
+	var missing []string
+	// Packages can be listed more than once in different categories
+	seen := map[string]bool{}
+	for _, p := range resolved {
+		if seen[p.Name] {
+			continue
+		}
+		seen[p.Name] = true
+		if _, ok := installed[p.Name]; ok {
+			continue
+		}
+		// Packages from the common key apply to any version of the distro
+		constraint := p.Constraint
+		if constraint == values.Common {
+			constraint = "any version"
+		}
+		missing = append(missing, fmt.Sprintf("%s (%s, %s)", p.Name, p.Category, constraint))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d of %d packages not installed: %s", len(missing), len(seen), strings.Join(missing, ", "))
+	}
+	return nil
+}
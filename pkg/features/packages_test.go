@@ -0,0 +1,105 @@
+package features
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestResolvePackagesOverrides(t *testing.T) {
+	// overrides returns the overrides for ubuntu amd64 in the category, for any version
+	overrides := func(category values.PackageCategory, packages ...string) map[values.PackageCategory]values.PackageMap {
+		return map[values.PackageCategory]values.PackageMap{
+			category: {values.Ubuntu: {values.ArchAMD64: {values.Common: packages}}},
+		}
+	}
+	tests := []struct {
+		name      string
+		overrides values.PackageOverrides
+		strict    bool
+		present   []string
+		absent    []string
+		fail      bool
+	}{
+		{
+			name:      "add to common",
+			overrides: values.PackageOverrides{Add: overrides(values.CommonCategory, "vim")},
+			present:   []string{"vim", "nano"},
+		},
+		{
+			name:      "remove from common",
+			overrides: values.PackageOverrides{Remove: overrides(values.CommonCategory, "nano")},
+			present:   []string{"sudo"},
+			absent:    []string{"nano"},
+		},
+		{
+			name:      "remove from category",
+			overrides: values.PackageOverrides{Remove: overrides(values.BaseCategory, "conntrack")},
+			present:   []string{"nano"},
+			absent:    []string{"conntrack"},
+		},
+		{
+			// Removals only apply to their own category
+			name:      "remove from the wrong category",
+			overrides: values.PackageOverrides{Remove: overrides(values.BaseCategory, "nano")},
+			present:   []string{"nano"},
+		},
+		{
+			name:      "remove from the wrong category strict",
+			overrides: values.PackageOverrides{Remove: overrides(values.BaseCategory, "nano")},
+			strict:    true,
+			fail:      true,
+		},
+		{
+			name:      "remove not found strict",
+			overrides: values.PackageOverrides{Remove: overrides(values.CommonCategory, "not-a-package")},
+			strict:    true,
+			fail:      true,
+		},
+		{
+			name:      "remove found strict",
+			overrides: values.PackageOverrides{Remove: overrides(values.CommonCategory, "nano")},
+			strict:    true,
+			absent:    []string{"nano"},
+		},
+	}
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := values.System{
+				Distro:           values.Ubuntu,
+				Family:           values.DebianFamily,
+				Version:          "24.04",
+				Arch:             values.ArchAMD64,
+				PackageOverrides: tt.overrides,
+				StrictPackages:   tt.strict,
+			}
+			resolved, err := ResolvePackages(s, l)
+			if tt.fail {
+				if err == nil {
+					t.Fatal("ResolvePackages() expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolvePackages() unexpected error: %v", err)
+			}
+			var names []string
+			for _, p := range resolved {
+				names = append(names, p.Name)
+			}
+			for _, p := range tt.present {
+				if !slices.Contains(names, p) {
+					t.Errorf("%s not resolved, got %v", p, names)
+				}
+			}
+			for _, p := range tt.absent {
+				if slices.Contains(names, p) {
+					t.Errorf("%s resolved, got %v", p, names)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package features
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// releaseKey describes a key of the release file
+type releaseKey struct {
+	required bool
+	validate func(string) error // Optional, checks the value is well-formed
+}
+
+// releaseSchema are the keys known to be on the release file. Anything else is flagged, as it is probably
+// a leftover from testing or an old version
+var releaseSchema = map[string]releaseKey{
+	"KAIROS_ID":                      {required: true, validate: oneOf("kairos")},
+	"KAIROS_NAME":                    {required: true},
+	"KAIROS_ID_LIKE":                 {},
+	"KAIROS_PRETTY_NAME":             {},
+	"KAIROS_VERSION":                 {required: true, validate: validSemver},
+	"KAIROS_VERSION_ID":              {validate: validSemver},
+	"KAIROS_RELEASE":                 {validate: validSemver},
+	"KAIROS_VARIANT":                 {required: true, validate: oneOf(values.CoreVariant, values.StandardVariant)},
+	"KAIROS_MODEL":                   {required: true}, // Immucore needs it to boot
+	"KAIROS_FLAVOR":                  {required: true, validate: oneOf(stringsOf(values.Distros())...)},
+	"KAIROS_FLAVOR_RELEASE":          {required: true},
+	"KAIROS_FAMILY":                  {validate: oneOf(stringsOf(values.Families())...)},
+	"KAIROS_ARCH":                    {required: true, validate: oneOf(stringsOf(values.Architectures())...)},
+	"KAIROS_TARGETARCH":              {validate: oneOf(stringsOf(values.Architectures())...)},
+	"KAIROS_IMAGE_LABEL":             {},
+	"KAIROS_REGISTRY_AND_ORG":        {},
+	"KAIROS_IMAGE_REPO":              {},
+	"KAIROS_ARTIFACT":                {},
+	"KAIROS_GITHUB_REPO":             {},
+	"KAIROS_HOME_URL":                {},
+	"KAIROS_BUG_REPORT_URL":          {},
+	"KAIROS_SOFTWARE_VERSION_PREFIX": {validate: oneOf(values.K8sProviders()...)},
+	"KAIROS_SOFTWARE_VERSION":        {},
+	"KAIROS_FRAMEWORK_IMAGE":         {},
+	"KAIROS_FRAMEWORK_DIGEST":        {},
+}
+
+// validSemver checks the value is a semver version, with or without the v prefix
+func validSemver(value string) error {
+	if _, err := semver.StrictNewVersion(strings.TrimPrefix(value, "v")); err != nil {
+		return fmt.Errorf("%s is not a semver version", value)
+	}
+	return nil
+}
+
+// oneOf returns a validation that checks the value is one of the known ones
+func oneOf(known ...string) func(string) error {
+	return func(value string) error {
+		if !slices.Contains(known, value) {
+			return fmt.Errorf("%s is not one of %s", value, strings.Join(known, ", "))
+		}
+		return nil
+	}
+}
+
+// stringsOf converts a list of string types, like values.Distro, to plain strings
+func stringsOf[T ~string](list []T) []string {
+	var out []string
+	for _, v := range list {
+		out = append(out, string(v))
+	}
+	return out
+}
+
+// missingReleaseKeys returns an error listing the required keys that are missing or empty
+func missingReleaseKeys(release map[string]string) error {
+	var missing []string
+	for _, key := range slices.Sorted(maps.Keys(releaseSchema)) {
+		if releaseSchema[key].required && release[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	// The standard variant is the one with a k8s provider, so it needs to say which one
+	if release["KAIROS_VARIANT"] == values.StandardVariant && release["KAIROS_SOFTWARE_VERSION_PREFIX"] == "" {
+		missing = append(missing, "KAIROS_SOFTWARE_VERSION_PREFIX")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing keys: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// invalidReleaseValues returns an error listing the keys whose values are not well-formed
+func invalidReleaseValues(release map[string]string) error {
+	var invalid []string
+	for _, key := range slices.Sorted(maps.Keys(release)) {
+		schema, ok := releaseSchema[key]
+		if !ok || schema.validate == nil || release[key] == "" {
+			continue
+		}
+		if err := schema.validate(release[key]); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid values: %s", strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// unknownReleaseKeys returns an error listing the keys that are not part of the schema
+func unknownReleaseKeys(release map[string]string) error {
+	var unknown []string
+	for _, key := range slices.Sorted(maps.Keys(release)) {
+		if _, ok := releaseSchema[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown keys: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package features
+
+import (
+	"strings"
+	"testing"
+)
+
+// validRelease returns a release with all the required keys set to valid values
+func validRelease() map[string]string {
+	return map[string]string{
+		"KAIROS_ID":             "kairos",
+		"KAIROS_NAME":           "kairos-core-ubuntu-24.04",
+		"KAIROS_VERSION":        "v3.2.3",
+		"KAIROS_VARIANT":        "core",
+		"KAIROS_MODEL":          "generic",
+		"KAIROS_FLAVOR":         "ubuntu",
+		"KAIROS_FLAVOR_RELEASE": "24.04",
+		"KAIROS_ARCH":           "amd64",
+	}
+}
+
+func TestValidSemver(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"v3.2.3", true},
+		{"3.2.3", true},
+		{"v3.2.3-rc1", true},
+		{"v3.2.3+build", true},
+		{"v3.2", false},
+		{"3", false},
+		{"latest", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			err := validSemver(tt.value)
+			if (err == nil) != tt.valid {
+				t.Errorf("validSemver(%q) = %v, want valid %v", tt.value, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	validate := oneOf("amd64", "arm64")
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"amd64", true},
+		{"arm64", true},
+		{"x86", false},
+		{"AMD64", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			err := validate(tt.value)
+			if (err == nil) != tt.valid {
+				t.Errorf("oneOf(%q) = %v, want valid %v", tt.value, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMissingReleaseKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(map[string]string)
+		missing []string
+	}{
+		{"valid", func(map[string]string) {}, nil},
+		{"no model", func(r map[string]string) { delete(r, "KAIROS_MODEL") }, []string{"KAIROS_MODEL"}},
+		{"empty version", func(r map[string]string) { r["KAIROS_VERSION"] = "" }, []string{"KAIROS_VERSION"}},
+		{"standard without provider", func(r map[string]string) { r["KAIROS_VARIANT"] = "standard" }, []string{"KAIROS_SOFTWARE_VERSION_PREFIX"}},
+		{"standard with provider", func(r map[string]string) {
+			r["KAIROS_VARIANT"] = "standard"
+			r["KAIROS_SOFTWARE_VERSION_PREFIX"] = "k3s"
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := validRelease()
+			tt.change(release)
+			assertReleaseError(t, missingReleaseKeys(release), tt.missing)
+		})
+	}
+}
+
+func TestInvalidReleaseValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(map[string]string)
+		invalid []string
+	}{
+		{"valid", func(map[string]string) {}, nil},
+		{"bad version", func(r map[string]string) { r["KAIROS_VERSION"] = "3.2" }, []string{"KAIROS_VERSION"}},
+		{"unknown arch", func(r map[string]string) { r["KAIROS_ARCH"] = "x86" }, []string{"KAIROS_ARCH"}},
+		{"unknown flavor", func(r map[string]string) { r["KAIROS_FLAVOR"] = "gentoo" }, []string{"KAIROS_FLAVOR"}},
+		{"unknown provider", func(r map[string]string) { r["KAIROS_SOFTWARE_VERSION_PREFIX"] = "rke2" }, []string{"KAIROS_SOFTWARE_VERSION_PREFIX"}},
+		{"several", func(r map[string]string) {
+			r["KAIROS_ARCH"] = "x86"
+			r["KAIROS_VARIANT"] = "full"
+		}, []string{"KAIROS_ARCH", "KAIROS_VARIANT"}},
+		{"unknown keys are not validated", func(r map[string]string) { r["KAIROS_TEST"] = "x86" }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := validRelease()
+			tt.change(release)
+			assertReleaseError(t, invalidReleaseValues(release), tt.invalid)
+		})
+	}
+}
+
+func TestUnknownReleaseKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(map[string]string)
+		unknown []string
+	}{
+		{"valid", func(map[string]string) {}, nil},
+		{"framework keys", func(r map[string]string) {
+			r["KAIROS_FRAMEWORK_IMAGE"] = "quay.io/kairos/framework:v2.14.4"
+			r["KAIROS_FRAMEWORK_DIGEST"] = "sha256:abc"
+		}, nil},
+		{"test leftover", func(r map[string]string) { r["KAIROS_TEST_FOO"] = "1" }, []string{"KAIROS_TEST_FOO"}},
+		{"old key", func(r map[string]string) { r["KAIROS_PROVIDER"] = "k3s" }, []string{"KAIROS_PROVIDER"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := validRelease()
+			tt.change(release)
+			assertReleaseError(t, unknownReleaseKeys(release), tt.unknown)
+		})
+	}
+}
+
+// assertReleaseError checks that the error mentions exactly the given keys, or that there is no error if none
+func assertReleaseError(t *testing.T, err error, keys []string) {
+	t.Helper()
+	if len(keys) == 0 {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("expected an error about %v", keys)
+	}
+	for _, key := range keys {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not mention %s", err, key)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package features
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Services are enabled, disabled and masked by manipulating the symlinks directly, the same way systemctl and
+// rc-update do, as there is no running init system to talk to when building a container image.
+
+// systemdConfigDir is where the enablement symlinks for the systemd units live
+const systemdConfigDir = "/etc/systemd/system"
+
+// systemdUnitDirs are the directories where the systemd unit files are looked up, in order of precedence
+var systemdUnitDirs = []string{systemdConfigDir, "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// openrcDefaultRunlevel is the runlevel used when the service does not set one
+const openrcDefaultRunlevel = "default"
+
+// unitInstall is the [Install] section of a systemd unit
+type unitInstall struct {
+	WantedBy   []string
+	RequiredBy []string
+	Alias      []string
+}
+
+// findUnit returns the path of the unit file on the system, without the root prefix.
+// Instances of template units, like getty@tty1.service, are looked up by their template
+func findUnit(s values.System, unit string) (string, error) {
+	names := []string{unit}
+	if at := strings.Index(unit, "@"); at != -1 {
+		names = append(names, unit[:at+1]+filepath.Ext(unit))
+	}
+	for _, dir := range systemdUnitDirs {
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			info, err := os.Lstat(s.RootPath(path))
+			if err != nil {
+				continue
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				return path, nil
+			}
+			// Units in the config dir can be links to the real unit or to /dev/null when masked
+			target, err := os.Readlink(s.RootPath(path))
+			if err != nil {
+				return "", err
+			}
+			if target == "/dev/null" {
+				return "", fmt.Errorf("unit %s is masked", unit)
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(dir, target)
+			}
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("unit %s not found: %w", unit, os.ErrNotExist)
+}
+
+// readUnitInstall reads the [Install] section of the unit file
+func readUnitInstall(s values.System, path string) (unitInstall, error) {
+	install := unitInstall{}
+	f, err := os.Open(s.RootPath(path))
+	if err != nil {
+		return install, err
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if section != "[Install]" || !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "WantedBy":
+			install.WantedBy = append(install.WantedBy, strings.Fields(value)...)
+		case "RequiredBy":
+			install.RequiredBy = append(install.RequiredBy, strings.Fields(value)...)
+		case "Alias":
+			install.Alias = append(install.Alias, strings.Fields(value)...)
+		}
+	}
+	return install, scanner.Err()
+}
+
+// addLink creates the link and records it on the manifest if it was not there already
+func addLink(s values.System, target, path string, m *Manifest, l sdkTypes.KairosLogger) error {
+	created, err := createLink(s, target, s.RootPath(path), l)
+	if err != nil || !created {
+		return err
+	}
+	return m.AddFile(s, path)
+}
+
+// removeLinks removes the symlinks matching the glob and records them on the manifest
+func removeLinks(s values.System, glob string, m *Manifest, l sdkTypes.KairosLogger) error {
+	matches, err := filepath.Glob(s.RootPath(glob))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		info, err := os.Lstat(match)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err = removePath(s, match, l); err != nil {
+			return err
+		}
+		path, err := systemPath(s, match)
+		if err != nil {
+			return err
+		}
+		m.AddRemoved(path)
+	}
+	return nil
+}
+
+// enableSystemdUnit links the unit into the targets listed on its [Install] section, like systemctl enable
+func enableSystemdUnit(s values.System, unit string, m *Manifest, l sdkTypes.KairosLogger) error {
+	path, err := findUnit(s, unit)
+	if err != nil {
+		if s.DryRun() {
+			// On dry-run the unit is probably not installed yet as the packages were not installed
+			l.Logger.Warn().Err(err).Str("unit", unit).Msg("Unit not installed yet, cannot know which links would be created.")
+			s.Plan.AddCreated(s.RootPath(filepath.Join(systemdConfigDir, "*.wants", unit)) + " (unit not installed yet)")
+			return nil
+		}
+		return err
+	}
+	install, err := readUnitInstall(s, path)
+	if err != nil {
+		return err
+	}
+	if len(install.WantedBy) == 0 && len(install.RequiredBy) == 0 && len(install.Alias) == 0 {
+		l.Logger.Warn().Str("unit", unit).Msg("Unit has no [Install] section, nothing to enable.")
+		return nil
+	}
+	for _, target := range install.WantedBy {
+		if err = addLink(s, path, filepath.Join(systemdConfigDir, target+".wants", unit), m, l); err != nil {
+			return err
+		}
+	}
+	for _, target := range install.RequiredBy {
+		if err = addLink(s, path, filepath.Join(systemdConfigDir, target+".requires", unit), m, l); err != nil {
+			return err
+		}
+	}
+	for _, alias := range install.Alias {
+		if err = addLink(s, path, filepath.Join(systemdConfigDir, alias), m, l); err != nil {
+			return err
+		}
+	}
+	l.Logger.Info().Str("unit", unit).Msg("Enabled unit")
+	return nil
+}
+
+// disableSystemdUnit removes the links of the unit from all the targets, like systemctl disable
+func disableSystemdUnit(s values.System, unit string, m *Manifest, l sdkTypes.KairosLogger) error {
+	if err := removeLinks(s, filepath.Join(systemdConfigDir, "*", unit), m, l); err != nil {
+		return err
+	}
+	l.Logger.Info().Str("unit", unit).Msg("Disabled unit")
+	return nil
+}
+
+// maskSystemdUnit links the unit to /dev/null so it cannot be started, like systemctl mask
+func maskSystemdUnit(s values.System, unit string, m *Manifest, l sdkTypes.KairosLogger) error {
+	if err := addLink(s, "/dev/null", filepath.Join(systemdConfigDir, unit), m, l); err != nil {
+		return err
+	}
+	l.Logger.Info().Str("unit", unit).Msg("Masked unit")
+	return nil
+}
+
+// parseOpenRCService splits the "name:runlevel" notation, using the default runlevel if none is set
+func parseOpenRCService(service string) (string, string) {
+	name, runlevel, found := strings.Cut(service, ":")
+	if !found || runlevel == "" {
+		runlevel = openrcDefaultRunlevel
+	}
+	return name, runlevel
+}
+
+// enableOpenRCService links the service into its runlevel, like rc-update add
+func enableOpenRCService(s values.System, service string, m *Manifest, l sdkTypes.KairosLogger) error {
+	name, runlevel := parseOpenRCService(service)
+	script := filepath.Join("/etc/init.d", name)
+	if _, err := os.Stat(s.RootPath(script)); err != nil {
+		if !s.DryRun() {
+			return fmt.Errorf("service %s not found: %w", name, err)
+		}
+		l.Logger.Warn().Err(err).Str("service", name).Msg("Service not installed yet.")
+	}
+	if err := addLink(s, script, filepath.Join("/etc/runlevels", runlevel, name), m, l); err != nil {
+		return err
+	}
+	l.Logger.Info().Str("service", name).Str("runlevel", runlevel).Msg("Enabled service")
+	return nil
+}
+
+// disableOpenRCService removes the service from all the runlevels, like rc-update del
+func disableOpenRCService(s values.System, service string, m *Manifest, l sdkTypes.KairosLogger) error {
+	name, _ := parseOpenRCService(service)
+	if err := removeLinks(s, filepath.Join("/etc/runlevels", "*", name), m, l); err != nil {
+		return err
+	}
+	l.Logger.Info().Str("service", name).Msg("Disabled service")
+	return nil
+}
+
+// systemdUnitEnabled checks that the unit is linked into all the targets listed on its [Install] section
+func systemdUnitEnabled(s values.System, unit string) error {
+	path, err := findUnit(s, unit)
+	if err != nil {
+		return err
+	}
+	install, err := readUnitInstall(s, path)
+	if err != nil {
+		return err
+	}
+	var links []string
+	for _, target := range install.WantedBy {
+		links = append(links, filepath.Join(systemdConfigDir, target+".wants", unit))
+	}
+	for _, target := range install.RequiredBy {
+		links = append(links, filepath.Join(systemdConfigDir, target+".requires", unit))
+	}
+	for _, alias := range install.Alias {
+		links = append(links, filepath.Join(systemdConfigDir, alias))
+	}
+	for _, link := range links {
+		if _, err = os.Lstat(s.RootPath(link)); err != nil {
+			return fmt.Errorf("unit %s is not enabled, %s is missing", unit, link)
+		}
+	}
+	return nil
+}
+
+// systemdUnitDisabled checks that the unit is not linked into any target
+func systemdUnitDisabled(s values.System, unit string) error {
+	matches, err := filepath.Glob(s.RootPath(filepath.Join(systemdConfigDir, "*", unit)))
+	if err != nil {
+		return err
+	}
+	if len(matches) > 0 {
+		return fmt.Errorf("unit %s is still enabled", unit)
+	}
+	return nil
+}
+
+// systemdUnitMasked checks that the unit is linked to /dev/null
+func systemdUnitMasked(s values.System, unit string) error {
+	target, err := os.Readlink(s.RootPath(filepath.Join(systemdConfigDir, unit)))
+	if err != nil || target != "/dev/null" {
+		return fmt.Errorf("unit %s is not masked", unit)
+	}
+	return nil
+}
+
+// openRCServiceEnabled checks that the service is linked into its runlevel
+func openRCServiceEnabled(s values.System, service string) error {
+	name, runlevel := parseOpenRCService(service)
+	if _, err := os.Lstat(s.RootPath(filepath.Join("/etc/runlevels", runlevel, name))); err != nil {
+		return fmt.Errorf("service %s is not enabled on the %s runlevel", name, runlevel)
+	}
+	return nil
+}
+
+// openRCServiceDisabled checks that the service is not on any runlevel
+func openRCServiceDisabled(s values.System, service string) error {
+	name, _ := parseOpenRCService(service)
+	matches, err := filepath.Glob(s.RootPath(filepath.Join("/etc/runlevels", "*", name)))
+	if err != nil {
+		return err
+	}
+	if len(matches) > 0 {
+		return fmt.Errorf("service %s is still enabled", name)
+	}
+	return nil
+}
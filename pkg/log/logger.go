@@ -1,5 +1,16 @@
 package log
 
-import sdkTypes "github.com/kairos-io/kairos-sdk/types"
+import (
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"github.com/rs/zerolog"
+	"os"
+	"time"
+)
 
 var Log = sdkTypes.NewKairosLogger("kairos-init", "info", false)
+
+// ToStderr sends the logs to stderr instead of stdout, keeping the level, so stdout only carries the command output.
+// Used for machine-readable outputs like json, that would break with log lines in the middle
+func ToStderr() {
+	Log.Logger = Log.Logger.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+}
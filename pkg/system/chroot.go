@@ -0,0 +1,112 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// chrootMounts are the host paths that are bind mounted into the system root so package managers
+// and dracut work when run chrooted into it
+var chrootMounts = []string{"/dev", "/proc", "/sys"}
+
+// PrepareChroot bind mounts the host special filesystems and resolv.conf into the system root.
+// It returns a function that undoes the mounts, which should always be called once we are done with the root
+func PrepareChroot(s values.System, l sdkTypes.KairosLogger) (func(), error) {
+	var mounted []string
+	// restore undoes the changes made to the root to be able to mount on it, once everything is unmounted
+	var restore []func()
+	cleanup := func() {
+		// Unmount in reverse order
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(mounted[i], syscall.MNT_DETACH); err != nil {
+				l.Logger.Warn().Err(err).Str("path", mounted[i]).Msg("Error unmounting path")
+			}
+		}
+		for _, r := range restore {
+			r()
+		}
+	}
+
+	for _, m := range chrootMounts {
+		target := s.RootPath(m)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		l.Logger.Debug().Str("source", m).Str("target", target).Msg("Bind mounting path")
+		if err := syscall.Mount(m, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			l.Logger.Error().Err(err).Str("source", m).Str("target", target).Msg("Error bind mounting path")
+			cleanup()
+			return func() {}, err
+		}
+		mounted = append(mounted, target)
+	}
+
+	// Package managers need name resolution to fetch packages
+	resolv, undo, err := resolvConfMountpoint(s, l)
+	if err != nil {
+		l.Logger.Warn().Err(err).Msg("Cannot mount resolv.conf, name resolution may not work in the root")
+		return cleanup, nil
+	}
+	if err = syscall.Mount("/etc/resolv.conf", resolv, "", syscall.MS_BIND, ""); err != nil {
+		l.Logger.Warn().Err(err).Msg("Error bind mounting resolv.conf, name resolution may not work in the root")
+		undo()
+		return cleanup, nil
+	}
+	mounted = append(mounted, resolv)
+	restore = append(restore, undo)
+
+	return cleanup, nil
+}
+
+// resolvConfMountpoint returns the resolv.conf in the root to mount the host one over, and a function to undo
+// the changes made to get it.
+// Distros usually ship it as a link to a file under /run, that does not exist until boot. The link is not followed,
+// as an absolute target would point to a file in the host, so it is moved aside and put back by the undo function
+func resolvConfMountpoint(s values.System, l sdkTypes.KairosLogger) (string, func(), error) {
+	resolv := s.RootPath("/etc/resolv.conf")
+	info, err := os.Lstat(resolv)
+	switch {
+	case err == nil && info.Mode().IsRegular():
+		return resolv, func() {}, nil
+	case err == nil && info.Mode()&os.ModeSymlink != 0:
+		backup := resolv + ".kairos-init"
+		if err = os.Rename(resolv, backup); err != nil {
+			return "", nil, err
+		}
+		undo := func() {
+			if err := os.Remove(resolv); err != nil {
+				l.Logger.Warn().Err(err).Str("path", resolv).Msg("Error removing resolv.conf")
+			}
+			if err := os.Rename(backup, resolv); err != nil {
+				l.Logger.Warn().Err(err).Str("path", resolv).Msg("Error restoring resolv.conf link")
+			}
+		}
+		if err = os.WriteFile(resolv, nil, 0644); err != nil {
+			undo()
+			return "", nil, err
+		}
+		return resolv, undo, nil
+	case err == nil:
+		return "", nil, fmt.Errorf("%s is not a file or a link", resolv)
+	case errors.Is(err, os.ErrNotExist):
+		if err = os.MkdirAll(filepath.Dir(resolv), 0755); err != nil {
+			return "", nil, err
+		}
+		if err = os.WriteFile(resolv, nil, 0644); err != nil {
+			return "", nil, err
+		}
+		return resolv, func() {
+			if err := os.Remove(resolv); err != nil {
+				l.Logger.Warn().Err(err).Str("path", resolv).Msg("Error removing resolv.conf")
+			}
+		}, nil
+	default:
+		return "", nil, err
+	}
+}
@@ -0,0 +1,74 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestResolvConfMountpoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(resolv string) error
+		// link is the target the resolv.conf has to link to after undoing, if any
+		link string
+	}{
+		{"file", func(resolv string) error { return os.WriteFile(resolv, []byte("nameserver 1.1.1.1\n"), 0644) }, ""},
+		{"missing", func(string) error { return nil }, ""},
+		{"relative link", func(resolv string) error {
+			return os.Symlink("../run/systemd/resolve/stub-resolv.conf", resolv)
+		}, "../run/systemd/resolve/stub-resolv.conf"},
+		// Absolute links would point to the host if followed
+		{"absolute link", func(resolv string) error {
+			return os.Symlink("/run/systemd/resolve/stub-resolv.conf", resolv)
+		}, "/run/systemd/resolve/stub-resolv.conf"},
+	}
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := values.System{Root: t.TempDir()}
+			resolv := s.RootPath("/etc/resolv.conf")
+			if err := os.MkdirAll(filepath.Dir(resolv), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.setup(resolv); err != nil {
+				t.Fatal(err)
+			}
+			_, existed := os.Lstat(resolv)
+
+			mountpoint, undo, err := resolvConfMountpoint(s, l)
+			if err != nil {
+				t.Fatalf("resolvConfMountpoint() unexpected error: %v", err)
+			}
+			if mountpoint != resolv {
+				t.Errorf("mountpoint = %s, want %s", mountpoint, resolv)
+			}
+			if info, err := os.Lstat(mountpoint); err != nil || !info.Mode().IsRegular() {
+				t.Fatalf("mountpoint is not a regular file: %v", err)
+			}
+
+			undo()
+			info, err := os.Lstat(resolv)
+			switch {
+			case tt.link != "":
+				if target, _ := os.Readlink(resolv); target != tt.link {
+					t.Errorf("resolv.conf links to %q after undoing, want %q", target, tt.link)
+				}
+			case existed == nil:
+				if err != nil || !info.Mode().IsRegular() {
+					t.Errorf("resolv.conf not kept after undoing: %v", err)
+				}
+			default:
+				if err == nil {
+					t.Error("resolv.conf not removed after undoing")
+				}
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(resolv)); len(entries) > 1 {
+				t.Errorf("extra files left in /etc: %v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package system
+
+import (
+	"fmt"
+	"github.com/kairos-io/kairos-init/pkg/features"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"slices"
+)
+
+// Overrides are values set by the user that take precedence over the detected ones
+// Empty values are not applied
+type Overrides struct {
+	Distro    string
+	Family    string
+	Version   string
+	Arch      string
+	Installer string
+}
+
+// Apply validates the overrides and sets them into the system
+// Overriding the distro also sets the family and installer for it, unless those are overridden as well
+// Applied overrides are stored in the system so they show up when dumping it
+func (o Overrides) Apply(s *values.System, l sdkTypes.KairosLogger) error {
+	applied := map[string]string{}
+	if o.Distro != "" {
+		info, ok := distros[values.Distro(o.Distro)]
+		if !ok {
+			return fmt.Errorf("unknown distro %s. Known distros: %v", o.Distro, values.Distros())
+		}
+		s.Distro = values.Distro(o.Distro)
+		s.Family = info.family
+		s.Installer = info.installer
+		applied["distro"] = o.Distro
+	}
+	if o.Family != "" {
+		if !slices.Contains(values.Families(), values.Family(o.Family)) {
+			return fmt.Errorf("unknown family %s. Known families: %v", o.Family, values.Families())
+		}
+		s.Family = values.Family(o.Family)
+		applied["family"] = o.Family
+	}
+	if o.Version != "" {
+		s.Version = o.Version
+		applied["version"] = o.Version
+	}
+	if o.Arch != "" {
+		if !slices.Contains(values.Architectures(), values.Architecture(o.Arch)) {
+			return fmt.Errorf("unknown arch %s. Known archs: %v", o.Arch, values.Architectures())
+		}
+		s.Arch = values.Architecture(o.Arch)
+		applied["arch"] = o.Arch
+	}
+	if o.Installer != "" {
+		if !slices.Contains(features.Installers(), features.Installer(o.Installer)) {
+			return fmt.Errorf("unknown installer %s. Known installers: %v", o.Installer, features.Installers())
+		}
+		s.Installer = features.Installer(o.Installer)
+		applied["installer"] = o.Installer
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+	l.Logger.Info().Interface("overrides", applied).Msg("Overriding detected system values")
+	s.Overrides = applied
+	// Workarounds depend on the distro, arch and version so they need to be reloaded
+	loadWorkarounds(s, l)
+	return nil
+}
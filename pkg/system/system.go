@@ -10,14 +10,36 @@ import (
 	"runtime"
 )
 
-func DetectSystem(l sdkTypes.KairosLogger) values.System {
+// distroInfo holds the values that are fixed for each distro
+type distroInfo struct {
+	family    values.Family
+	installer features.Installer
+}
+
+// distros maps each known distro to its family and installer
+var distros = map[values.Distro]distroInfo{
+	values.Debian:             {values.DebianFamily, features.APTInstaller},
+	values.Ubuntu:             {values.DebianFamily, features.APTInstaller},
+	values.Fedora:             {values.RedHatFamily, features.DNFInstaller},
+	values.RockyLinux:         {values.RedHatFamily, features.DNFInstaller},
+	values.AlmaLinux:          {values.RedHatFamily, features.DNFInstaller},
+	values.RedHat:             {values.RedHatFamily, features.DNFInstaller},
+	values.Arch:               {values.ArchFamily, features.PacmanInstaller},
+	values.Alpine:             {values.AlpineFamily, features.AlpineInstaller},
+	values.OpenSUSELeap:       {values.SUSEFamily, features.SUSEInstaller},
+	values.OpenSUSETumbleweed: {values.SUSEFamily, features.SUSEInstaller},
+}
+
+// DetectSystem detects the system living under the given root directory
+func DetectSystem(root string, l sdkTypes.KairosLogger) values.System {
 	// Detects the system
 	s := values.System{
 		Distro: values.Unknown,
 		Family: values.UnknownFamily,
+		Root:   root,
 	}
 
-	file, err := os.Open("/etc/os-release")
+	file, err := os.Open(s.RootPath("/etc/os-release"))
 	if err != nil {
 		return s
 	}
@@ -30,47 +52,10 @@ func DetectSystem(l sdkTypes.KairosLogger) values.System {
 	}
 	l.Logger.Trace().Interface("values", val).Msg("Read values from os-release")
 	// Match values to distros
-	switch values.Distro(val["ID"]) {
-	case values.Debian:
-		s.Distro = values.Debian
-		s.Family = values.DebianFamily
-		s.Installer = features.APTInstaller
-	case values.Ubuntu:
-		s.Distro = values.Ubuntu
-		s.Family = values.DebianFamily
-		s.Installer = features.APTInstaller
-	case values.Fedora:
-		s.Distro = values.Fedora
-		s.Family = values.RedHatFamily
-		s.Installer = features.DNFInstaller
-	case values.RockyLinux:
-		s.Distro = values.RockyLinux
-		s.Family = values.RedHatFamily
-		s.Installer = features.DNFInstaller
-	case values.AlmaLinux:
-		s.Distro = values.AlmaLinux
-		s.Family = values.RedHatFamily
-		s.Installer = features.DNFInstaller
-	case values.RedHat:
-		s.Distro = values.RedHat
-		s.Family = values.RedHatFamily
-		s.Installer = features.DNFInstaller
-	case values.Arch:
-		s.Distro = values.Arch
-		s.Family = values.ArchFamily
-		s.Installer = features.PacmanInstaller
-	case values.Alpine:
-		s.Distro = values.Alpine
-		s.Family = values.AlpineFamily
-		s.Installer = features.AlpineInstaller
-	case values.OpenSUSELeap:
-		s.Distro = values.OpenSUSELeap
-		s.Family = values.SUSEFamily
-		s.Installer = features.SUSEInstaller
-	case values.OpenSUSETumbleweed:
-		s.Distro = values.OpenSUSETumbleweed
-		s.Family = values.SUSEFamily
-		s.Installer = features.SUSEInstaller
+	if info, ok := distros[values.Distro(val["ID"])]; ok {
+		s.Distro = values.Distro(val["ID"])
+		s.Family = info.family
+		s.Installer = info.installer
 	}
 
 	// Match architecture
@@ -118,6 +103,14 @@ func DetectSystem(l sdkTypes.KairosLogger) values.System {
 
 	s.Features = []values.Feature{}
 
+	loadWorkarounds(&s, l)
+
+	return s
+}
+
+// loadWorkarounds sets the workarounds that apply to the system distro, arch and version
+func loadWorkarounds(s *values.System, l sdkTypes.KairosLogger) {
+	s.Workarounds = values.Workarounds{}
 	// Check if we have any workarounds for the system
 	if s.Distro != values.Unknown {
 		if workarounds, ok := values.WorkaroundsMap[s.Distro][s.Arch][s.Version]; ok {
@@ -127,6 +120,4 @@ func DetectSystem(l sdkTypes.KairosLogger) values.System {
 			}
 		}
 	}
-
-	return s
 }
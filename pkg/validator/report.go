@@ -0,0 +1,177 @@
+package validator
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats for the validation results
+const (
+	TextOutput  = "text"
+	JSONOutput  = "json"
+	JUnitOutput = "junit"
+)
+
+// OutputFormats returns the supported output formats for the validation results
+func OutputFormats() []string {
+	return []string{TextOutput, JSONOutput, JUnitOutput}
+}
+
+// WriteResults writes the results in the given format
+func WriteResults(w io.Writer, results []Result, format string) error {
+	switch format {
+	case TextOutput:
+		return writeText(w, results)
+	case JSONOutput:
+		return writeJSON(w, results)
+	case JUnitOutput:
+		return writeJUnit(w, results)
+	default:
+		return fmt.Errorf("unknown output format %s, must be one of %s", format, strings.Join(OutputFormats(), ", "))
+	}
+}
+
+// message returns the error of the result in a single line, as joined errors are one per line
+func (r Result) message() string {
+	if r.Passed() {
+		return ""
+	}
+	return strings.ReplaceAll(r.Err.Error(), "\n", "; ")
+}
+
+// status returns the result as PASS or FAIL
+func (r Result) status() string {
+	if r.Passed() {
+		return "PASS"
+	}
+	return "FAIL"
+}
+
+// writeText writes the results as a table with a row per check
+func writeText(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "FEATURE\tCHECK\tRESULT\tDURATION\tERROR")
+	for _, r := range results {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Feature, r.Check, r.status(), r.Duration.Round(time.Microsecond), r.message())
+	}
+	return tw.Flush()
+}
+
+type jsonResult struct {
+	Feature  string  `json:"feature"`
+	Check    string  `json:"check"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"duration"` // In seconds
+}
+
+type jsonReport struct {
+	Passed   bool         `json:"passed"`
+	Total    int          `json:"total"`
+	Failed   int          `json:"failed"`
+	Duration float64      `json:"duration"` // In seconds
+	Results  []jsonResult `json:"results"`
+}
+
+// writeJSON writes the results as a JSON report with the totals
+func writeJSON(w io.Writer, results []Result) error {
+	report := jsonReport{Results: []jsonResult{}}
+	var total time.Duration
+	for _, r := range results {
+		total += r.Duration
+		if !r.Passed() {
+			report.Failed++
+		}
+		report.Results = append(report.Results, jsonResult{
+			Feature:  r.Feature,
+			Check:    r.Check,
+			Status:   strings.ToLower(r.status()),
+			Message:  r.message(),
+			Duration: r.Duration.Seconds(),
+		})
+	}
+	report.Total = len(results)
+	report.Passed = report.Failed == 0
+	report.Duration = total.Seconds()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTime formats the duration in seconds, as JUnit expects
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
+
+// writeJUnit writes the results as JUnit XML, with a test suite per feature and a test case per check
+func writeJUnit(w io.Writer, results []Result) error {
+	report := junitTestSuites{Name: "kairos-init validate"}
+	var total time.Duration
+	// Results come grouped by feature, as the checks run feature by feature
+	var suiteTime time.Duration
+	for _, r := range results {
+		if len(report.Suites) == 0 || report.Suites[len(report.Suites)-1].Name != r.Feature {
+			suiteTime = 0
+			report.Suites = append(report.Suites, junitTestSuite{Name: r.Feature})
+		}
+		suite := &report.Suites[len(report.Suites)-1]
+		tc := junitTestCase{Name: r.Check, ClassName: r.Feature, Time: junitTime(r.Duration)}
+		if !r.Passed() {
+			tc.Failure = &junitFailure{Message: r.message(), Text: r.Err.Error()}
+			suite.Failures++
+			report.Failures++
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+		suite.Tests++
+		suiteTime += r.Duration
+		suite.Time = junitTime(suiteTime)
+		total += r.Duration
+	}
+	report.Tests = len(results)
+	report.Time = junitTime(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
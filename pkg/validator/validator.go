@@ -4,102 +4,69 @@
 package validator
 
 import (
-	"github.com/hashicorp/go-multierror"
+	"fmt"
 	"github.com/kairos-io/kairos-init/pkg/log"
 	"github.com/kairos-io/kairos-init/pkg/values"
-	"os"
-	"os/exec"
+	"io"
+	"slices"
 	"strings"
+	"time"
 )
 
-func ValidateFeatures(features []values.Feature) error {
-	var err *multierror.Error
-	for _, f := range features {
-		switch f.Name() {
-		case "immutability":
-			err = multierror.Append(err, validateBinaries())
-		case "kernel":
-			err = multierror.Append(err, validateKernel())
-		case "initrd":
-			err = multierror.Append(err, validateInitrd())
-		}
-	}
-	return err.ErrorOrNil()
+// Result is the outcome of a single check of a feature
+type Result struct {
+	Feature  string
+	Check    string
+	Err      error
+	Duration time.Duration
 }
 
-// validateKernel checks if the kernel is there and its linked from /boot/vmlinuz
-func validateKernel() error {
-	log.Log.Logger.Info().Msg("Validating kernel")
-	// check if the kernel is linked from /boot/vmlinuz so it should be a symlink and valid
-	link, stat := os.Lstat("/boot/vmlinuz")
-	if stat != nil {
-		return stat
-	}
-	if link.Mode()&os.ModeSymlink == 0 {
-		return &os.PathError{Op: "lstat", Path: "/boot/vmlinuz", Err: os.ErrInvalid}
-	}
-	// check if the link is valid
-	_, stat = os.Stat(link.Name())
-	if stat != nil {
-		return stat
-	}
-	return nil
+// Passed returns true if the check passed
+func (r Result) Passed() bool {
+	return r.Err == nil
 }
 
-// validateBinaries checks if the expected binaries are there
-func validateBinaries() error {
-	log.Log.Logger.Info().Msg("Validating binaries")
-	for _, bin := range values.BinariesCheck() {
-		// check if we have multiple binaries to check
-		// if we do, we check if any of them are present
-		// if none are present, we return an error
-		// we split the binaries by | for the same binary with different names in different OSes
-		split := strings.Split(bin, "|")
-		if len(split) > 1 {
-			found := false
-			for _, b := range split {
-				_, err := exec.LookPath(b)
-				if err == nil {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return &exec.Error{Name: strings.Join(split, " or "), Err: exec.ErrNotFound}
-			}
-		} else {
-			_, err := exec.LookPath(bin)
-			if err != nil {
-				return err
+// RunChecks runs the checks of the given features against the system, using its root for all the checks
+func RunChecks(s values.System, features []values.Feature) []Result {
+	var results []Result
+	for _, f := range features {
+		for _, check := range f.Checks(s, log.Log) {
+			log.Log.Logger.Info().Str("feature", f.Name()).Str("check", check.Name).Msg("Validating")
+			start := time.Now()
+			r := Result{Feature: f.Name(), Check: check.Name, Err: check.Fn()}
+			r.Duration = time.Since(start)
+			if !r.Passed() {
+				log.Log.Logger.Debug().Err(r.Err).Str("feature", f.Name()).Str("check", check.Name).Msg("Check failed")
 			}
+			results = append(results, r)
 		}
 	}
-	return nil
+	return results
 }
 
-// validateSystemd checks if systemd is the correct version
-// valid only fore UKI as we need a specific or higher version of systemd
-func validateSystemd() error {
-	log.Log.Logger.Info().Msg("Validating systemd")
+// Failed returns an error if any of the checks failed
+func Failed(results []Result) error {
+	failed := 0
+	for _, r := range results {
+		if !r.Passed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
 	return nil
 }
 
-// validateInitrd checks if the initrd is there and its linked from /boot/initrd
-// also checks if it has immucore and agent binary in the initrd
-func validateInitrd() error {
-	log.Log.Logger.Info().Msg("Validating initrd")
-	// check if the initrd is linked from /boot/initrd so it should be a symlink and valid
-	link, stat := os.Lstat("/boot/initrd")
-	if stat != nil {
-		return stat
-	}
-	if link.Mode()&os.ModeSymlink == 0 {
-		return &os.PathError{Op: "lstat", Path: "/boot/initrd", Err: os.ErrInvalid}
+// ValidateFeatures validates the given features against the system and writes the results in the given format.
+// It returns an error if any of the checks failed
+func ValidateFeatures(s values.System, features []values.Feature, w io.Writer, format string) error {
+	if !slices.Contains(OutputFormats(), format) {
+		return fmt.Errorf("unknown output format %s, must be one of %s", format, strings.Join(OutputFormats(), ", "))
 	}
-	// check if the link is valid, it points to a existing file
-	_, stat = os.Stat(link.Name())
-	if stat != nil {
-		return stat
+	results := RunChecks(s, features)
+	if err := WriteResults(w, results, format); err != nil {
+		return err
 	}
-	return stat
+	return Failed(results)
 }
@@ -2,7 +2,12 @@ package values
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"maps"
+	"slices"
 )
 import "text/template"
 
@@ -32,7 +37,6 @@ var CommonPackages = []string{
 	"tar",        // Basic tool.
 	"zstd",       // Compression support for zstd
 	"rsync",      // Install, upgrade, reset use it to sync the files
-	"systemd",    // Basic tool.
 	"dbus",       // Basic tool.
 	"lvm2",       // Seems to be used to support rpi3 only
 	"jq",         // No idea why we need it, check if we can drop it?
@@ -44,6 +48,158 @@ var CommonPackages = []string{
 type PackageMap map[Distro]map[Architecture]VersionMap
 type VersionMap map[string][]string
 
+// PackageCategory identifies each one of the package maps
+type PackageCategory string
+
+func (c PackageCategory) String() string {
+	return string(c)
+}
+
+const (
+	BaseCategory     PackageCategory = "base"
+	ImmucoreCategory PackageCategory = "immucore"
+	KernelCategory   PackageCategory = "kernel"
+	GrubCategory     PackageCategory = "grub"
+	SystemdCategory  PackageCategory = "systemd"
+	// CommonCategory is for the CommonPackages, which are not part of any PackageMap. It is not one of the
+	// PackageCategories, but the config overrides can use it to add or remove common packages
+	CommonCategory PackageCategory = "common"
+)
+
+// PackageCategories returns all the package categories in the order they are merged
+func PackageCategories() []PackageCategory {
+	return []PackageCategory{BaseCategory, ImmucoreCategory, KernelCategory, GrubCategory, SystemdCategory}
+}
+
+// AppliesTo returns true if the category packages are installed for the boot mode.
+// immucore and grub packages are only needed under grub, and the systemd ones only under trusted boot
+func (c PackageCategory) AppliesTo(mode BootMode) bool {
+	switch c {
+	case ImmucoreCategory, GrubCategory:
+		return mode == GrubBoot
+	case SystemdCategory:
+		return mode == TrustedBoot
+	default:
+		return true
+	}
+}
+
+// PackageMap returns the package map that backs the category
+func (c PackageCategory) PackageMap() PackageMap {
+	switch c {
+	case BaseCategory:
+		return BasePackages
+	case ImmucoreCategory:
+		return ImmucorePackages
+	case KernelCategory:
+		return KernelPackages
+	case GrubCategory:
+		return GrubPackages
+	case SystemdCategory:
+		return SystemdPackages
+	}
+	return PackageMap{}
+}
+
+// PackageOverrides are the user provided packages to add to or remove from each package map category, or from the
+// common packages with the common category.
+// They are keyed the same way as the package maps, so they can be scoped per distro, arch and version constraint.
+type PackageOverrides struct {
+	Add    map[PackageCategory]PackageMap `json:"add,omitempty" mapstructure:"add"`
+	Remove map[PackageCategory]PackageMap `json:"remove,omitempty" mapstructure:"remove"`
+}
+
+// Validate checks that the overrides only refer to known categories, distros and architectures
+func (o PackageOverrides) Validate() error {
+	known := append([]PackageCategory{CommonCategory}, PackageCategories()...)
+	for _, m := range []map[PackageCategory]PackageMap{o.Add, o.Remove} {
+		for category, packageMap := range m {
+			if !slices.Contains(known, category) {
+				return fmt.Errorf("unknown package category %s. Known categories: %v", category, known)
+			}
+			for distro, archs := range packageMap {
+				if !slices.Contains(Distros(), distro) {
+					return fmt.Errorf("unknown distro %s in package category %s", distro, category)
+				}
+				for arch := range archs {
+					if !slices.Contains(Architectures(), arch) {
+						return fmt.Errorf("unknown arch %s in package category %s", arch, category)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// MissingPackageCategories returns the categories that have no packages for the given distro, arch and version,
+// evaluating the version constraints the same way the packages are resolved. An empty version means any version,
+// so only categories without packages for any version are missing. Categories that do not apply to the boot mode
+// are never missing
+func MissingPackageCategories(d Distro, a Architecture, version string, mode BootMode) []PackageCategory {
+	var v *semver.Version
+	if version != "" {
+		// Same as when resolving, an unparseable version only gets the Common packages
+		v, _ = semver.NewVersion(version)
+	}
+	var missing []PackageCategory
+	for _, c := range PackageCategories() {
+		if !c.AppliesTo(mode) {
+			continue
+		}
+		packages := c.PackageMap()[d][a]
+		keys := slices.Collect(maps.Keys(packages))
+		if version != "" {
+			keys, _ = packages.MatchingConstraints(v)
+		}
+		found := 0
+		for _, k := range keys {
+			found += len(packages[k])
+		}
+		if found == 0 {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// MatchingConstraints returns the keys that apply to the given version, with the Common key first.
+// A nil version only matches the Common key. Keys that are not valid constraints never match, and are returned
+// as an error
+func (v VersionMap) MatchingConstraints(version *semver.Version) ([]string, error) {
+	var matching []string
+	var errs []error
+	for _, k := range v.sortedConstraints() {
+		// Add them if they are common
+		if k == Common {
+			matching = append(matching, k)
+			continue
+		}
+		if version == nil {
+			continue
+		}
+		constraint, err := semver.NewConstraint(k)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parsing constraint %s: %w", k, err))
+			continue
+		}
+		// Also add them if the constraint matches
+		if constraint.Check(version) {
+			matching = append(matching, k)
+		}
+	}
+	return matching, errors.Join(errs...)
+}
+
+// sortedConstraints returns the keys with the Common key first, so the resolution is stable
+func (v VersionMap) sortedConstraints() []string {
+	keys := slices.Sorted(maps.Keys(v))
+	if i := slices.Index(keys, Common); i > 0 {
+		keys = slices.Insert(slices.Delete(keys, i, i+1), 0, Common)
+	}
+	return keys
+}
+
 // ImmucorePackages are the minimum set of packages that immucore needs.
 // Otherwise you wont be able to build the initrd with immucore on it.
 var ImmucorePackages = PackageMap{
@@ -61,7 +217,178 @@ var ImmucorePackages = PackageMap{
 				"dracut-live", // Livenet support for dracut, split into a separate package on 22.04
 			},
 		},
-		ArchARM64: {},
+		ArchARM64: {
+			Common: {
+				"dracut",
+				"dracut-network",
+				"isc-dhcp-common",
+				"isc-dhcp-client",
+				"systemd-sysv",
+				"cloud-guest-utils",
+			},
+			">=22.04": {
+				"dracut-live",
+			},
+		},
+	},
+	Debian: {
+		ArchAMD64: {
+			Common: {
+				"dracut",
+				"dracut-network",
+				"isc-dhcp-common",
+				"isc-dhcp-client",
+				"systemd-sysv",
+				"cloud-guest-utils",
+			},
+			">=12": {
+				"dracut-live", // Livenet support for dracut, split into a separate package on bookworm
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"dracut",
+				"dracut-network",
+				"isc-dhcp-common",
+				"isc-dhcp-client",
+				"systemd-sysv",
+				"cloud-guest-utils",
+			},
+			">=12": {
+				"dracut-live",
+			},
+		},
+	},
+	Fedora: {
+		ArchAMD64: {
+			Common: {
+				"dracut",
+				"dracut-live", // Livenet support for dracut
+				"dracut-network",
+				"dracut-squash", // Squashfs support for dracut, needed for the recovery and live images
+				"cloud-utils-growpart",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+	},
+	RedHat: {
+		ArchAMD64: {
+			">=8": {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+	},
+	RockyLinux: {
+		ArchAMD64: {
+			">=8": {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+	},
+	AlmaLinux: {
+		ArchAMD64: {
+			">=8": {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"dracut",
+				"dracut-live",
+				"dracut-network",
+				"dracut-squash",
+				"cloud-utils-growpart",
+			},
+		},
+	},
+	OpenSUSELeap: {
+		ArchAMD64: {
+			Common: {
+				"dracut",
+				"growpart", // This brings growpart, so we can resize the partitions
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"dracut",
+				"growpart",
+			},
+		},
+	},
+	OpenSUSETumbleweed: {
+		ArchAMD64: {
+			Common: {
+				"dracut",
+				"growpart",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"dracut",
+				"growpart",
+			},
+		},
+	},
+	Arch: {
+		ArchAMD64: {
+			Common: {
+				"dracut",
+				"dhclient",          // Network-legacy support for dracut
+				"cloud-guest-utils", // This brings growpart, so we can resize the partitions
+			},
+		},
+	},
+	Alpine: {
+		ArchAMD64: {
+			Common: {
+				"dracut",
+				"cloud-utils-growpart",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"dracut",
+				"cloud-utils-growpart",
+			},
+		},
 	},
 }
 
@@ -77,6 +404,81 @@ var KernelPackages = PackageMap{
 			// Somehow 24.10 uses the 22.04 hwe kernel
 			"24.10": {"linux-image-generic-hwe-24.04"},
 		},
+		ArchARM64: {
+			">=20.04, != 24.10": {
+				"linux-image-generic-hwe-{{.version}}",
+			},
+			"24.10": {"linux-image-generic-hwe-24.04"},
+		},
+	},
+	Debian: {
+		ArchAMD64: {
+			Common: {"linux-image-amd64"},
+		},
+		ArchARM64: {
+			Common: {"linux-image-arm64"},
+		},
+	},
+	Fedora: {
+		ArchAMD64: {
+			Common: {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+		ArchARM64: {
+			Common: {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+	},
+	RedHat: {
+		ArchAMD64: {
+			">=8": {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+		ArchARM64: {
+			">=8": {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+	},
+	RockyLinux: {
+		ArchAMD64: {
+			">=8": {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+		ArchARM64: {
+			">=8": {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+	},
+	AlmaLinux: {
+		ArchAMD64: {
+			">=8": {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+		ArchARM64: {
+			">=8": {"kernel", "kernel-modules", "kernel-modules-extra"},
+		},
+	},
+	OpenSUSELeap: {
+		ArchAMD64: {
+			Common: {"kernel-default", "kernel-firmware-all"},
+		},
+		ArchARM64: {
+			Common: {"kernel-default", "kernel-firmware-all"},
+		},
+	},
+	OpenSUSETumbleweed: {
+		ArchAMD64: {
+			Common: {"kernel-default", "kernel-firmware-all"},
+		},
+		ArchARM64: {
+			Common: {"kernel-default", "kernel-firmware-all"},
+		},
+	},
+	Arch: {
+		ArchAMD64: {
+			Common: {"linux", "linux-firmware"},
+		},
+	},
+	Alpine: {
+		ArchAMD64: {
+			Common: {"linux-lts", "linux-firmware-none"},
+		},
+		ArchARM64: {
+			Common: {"linux-lts", "linux-firmware-none"},
+		},
 	},
 }
 
@@ -104,6 +506,7 @@ var BasePackages = PackageMap{
 				"open-iscsi",
 				"open-vm-tools",  // For vmware support, probably move it to a bundle?
 				"openssh-server", // Basic ssh server
+				"systemd",        // Init system
 				"systemd-timesyncd",
 				"systemd-container",      // Not sure if needed?
 				"ubuntu-advantage-tools", // For ubuntu advantage support, enablement of ubuntu services
@@ -123,13 +526,525 @@ var BasePackages = PackageMap{
 				"systemd-resolved", // For systemd-resolved support, added as a separate package on 24.04
 			},
 		},
-		ArchARM64: {},
+		ArchARM64: {
+			Common: {
+				"gdisk",
+				"fdisk",
+				"ca-certificates",
+				"conntrack",
+				"console-data",
+				"cloud-guest-utils",
+				"cryptsetup",
+				"debianutils",
+				"gettext",
+				"haveged",
+				"iproute2",
+				"iputils-ping",
+				"krb5-locales",
+				"nbd-client",
+				"nfs-common",
+				"open-iscsi",
+				"openssh-server",
+				"systemd",
+				"systemd-timesyncd",
+				"systemd-container",
+				"ubuntu-advantage-tools",
+				"xz-utils",
+				"tpm2-tools",
+				"dmsetup",
+				"mdadm",
+				"ncurses-term",
+				"networkd-dispatcher",
+				"packagekit-tools",
+				"publicsuffix",
+				"xdg-user-dirs",
+				"xxd",
+				"zerofree",
+			},
+			">=24.04": {
+				"systemd-resolved",
+			},
+		},
+	},
+	Debian: {
+		ArchAMD64: {
+			Common: {
+				"gdisk",
+				"fdisk",
+				"ca-certificates",
+				"conntrack",
+				"console-data",
+				"cloud-guest-utils",
+				"cryptsetup",
+				"debianutils",
+				"gettext",
+				"haveged",
+				"iproute2",
+				"iputils-ping",
+				"krb5-locales",
+				"nbd-client",
+				"nfs-common",
+				"open-iscsi",
+				"open-vm-tools",
+				"openssh-server",
+				"systemd",
+				"systemd-timesyncd",
+				"systemd-container",
+				"xz-utils",
+				"tpm2-tools",
+				"dmsetup",
+				"mdadm",
+				"ncurses-term",
+				"networkd-dispatcher",
+				"packagekit-tools",
+				"publicsuffix",
+				"xdg-user-dirs",
+				"xxd",
+				"zerofree",
+			},
+			">=12": {
+				"systemd-resolved", // Split into a separate package on bookworm
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"gdisk",
+				"fdisk",
+				"ca-certificates",
+				"conntrack",
+				"console-data",
+				"cloud-guest-utils",
+				"cryptsetup",
+				"debianutils",
+				"gettext",
+				"haveged",
+				"iproute2",
+				"iputils-ping",
+				"krb5-locales",
+				"nbd-client",
+				"nfs-common",
+				"open-iscsi",
+				"openssh-server",
+				"systemd",
+				"systemd-timesyncd",
+				"systemd-container",
+				"xz-utils",
+				"tpm2-tools",
+				"dmsetup",
+				"mdadm",
+				"ncurses-term",
+				"networkd-dispatcher",
+				"packagekit-tools",
+				"publicsuffix",
+				"xdg-user-dirs",
+				"xxd",
+				"zerofree",
+			},
+			">=12": {
+				"systemd-resolved",
+			},
+		},
+	},
+	Fedora: {
+		ArchAMD64: {
+			Common: {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"haveged",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"systemd-networkd", // Fedora defaults to NetworkManager, Kairos uses networkd
+				"systemd-resolved",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"haveged",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"systemd-networkd",
+				"systemd-resolved",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	// RHEL and its rebuilds ship no systemd-networkd nor haveged outside of EPEL, so we stick to NetworkManager
+	RedHat: {
+		ArchAMD64: {
+			// 8 and 9 name the packages the same, older versions are not supported
+			">=8": {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"NetworkManager",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"NetworkManager",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	RockyLinux: {
+		ArchAMD64: {
+			">=8": {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"NetworkManager",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"NetworkManager",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	AlmaLinux: {
+		ArchAMD64: {
+			">=8": {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"NetworkManager",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"audit",
+				"ca-certificates",
+				"cryptsetup",
+				"device-mapper",
+				"gdisk",
+				"iproute",
+				"iputils",
+				"iscsi-initiator-utils",
+				"mdadm",
+				"NetworkManager",
+				"nfs-utils",
+				"openssh-server",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	OpenSUSELeap: {
+		ArchAMD64: {
+			Common: {
+				"ca-certificates",
+				"conntrack-tools",
+				"cryptsetup",
+				"device-mapper",
+				"gptfdisk", // gdisk is named gptfdisk on openSUSE
+				"haveged",
+				"iproute2",
+				"iputils",
+				"lsscsi",
+				"mdadm",
+				"multipath-tools",
+				"nfs-client",
+				"open-iscsi",
+				"openssh-clients",
+				"openssh-server",
+				"polkit",
+				"procps",
+				"systemd",
+				"systemd-network", // networkd lives in its own package on openSUSE
+				"timezone",
+				"tpm2.0-tools",
+				"which",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"ca-certificates",
+				"conntrack-tools",
+				"cryptsetup",
+				"device-mapper",
+				"gptfdisk",
+				"haveged",
+				"iproute2",
+				"iputils",
+				"lsscsi",
+				"mdadm",
+				"multipath-tools",
+				"nfs-client",
+				"open-iscsi",
+				"openssh-clients",
+				"openssh-server",
+				"polkit",
+				"procps",
+				"systemd",
+				"systemd-network",
+				"timezone",
+				"tpm2.0-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	OpenSUSETumbleweed: {
+		ArchAMD64: {
+			Common: {
+				"ca-certificates",
+				"conntrack-tools",
+				"cryptsetup",
+				"device-mapper",
+				"gptfdisk",
+				"haveged",
+				"iproute2",
+				"iputils",
+				"lsscsi",
+				"mdadm",
+				"multipath-tools",
+				"nfs-client",
+				"open-iscsi",
+				"openssh-clients",
+				"openssh-server",
+				"polkit",
+				"procps",
+				"systemd",
+				"systemd-network",
+				"timezone",
+				"tpm2.0-tools",
+				"which",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"ca-certificates",
+				"conntrack-tools",
+				"cryptsetup",
+				"device-mapper",
+				"gptfdisk",
+				"haveged",
+				"iproute2",
+				"iputils",
+				"lsscsi",
+				"mdadm",
+				"multipath-tools",
+				"nfs-client",
+				"open-iscsi",
+				"openssh-clients",
+				"openssh-server",
+				"polkit",
+				"procps",
+				"systemd",
+				"systemd-network",
+				"timezone",
+				"tpm2.0-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	// Arch is a rolling release without VERSION_ID, so only the Common key will ever match.
+	// There is no arm64 on purpose: Arch Linux is x86_64 only and Arch Linux ARM is a separate distro with its own
+	// kernel and boot packages, so arm64 is reported as missing by the coverage check
+	Arch: {
+		ArchAMD64: {
+			Common: {
+				"ca-certificates",
+				"cloud-guest-utils",
+				"conntrack-tools",
+				"cryptsetup",
+				"device-mapper",
+				"gptfdisk",
+				"haveged",
+				"iproute2",
+				"iputils",
+				"mdadm",
+				"nfs-utils",
+				"open-iscsi",
+				"openssh",
+				"polkit",
+				"procps-ng",
+				"systemd",
+				"systemd-resolvconf",
+				"tpm2-tools",
+				"which",
+				"xz",
+			},
+		},
+	},
+	// Alpine uses openrc instead of systemd
+	Alpine: {
+		ArchAMD64: {
+			Common: {
+				"bash",
+				"blkid",
+				"busybox-openrc",
+				"ca-certificates",
+				"cloud-utils-growpart",
+				"connman", // Network manager for openrc systems
+				"conntrack-tools",
+				"coreutils",
+				"cryptsetup",
+				"dmidecode",
+				"e2fsprogs-extra",
+				"eudev", // udev for non systemd systems
+				"findutils",
+				"haveged",
+				"iproute2",
+				"libc6-compat",
+				"mdadm",
+				"multipath-tools",
+				"nfs-utils",
+				"open-iscsi",
+				"openrc",
+				"openssh-client",
+				"openssh-server",
+				"procps",
+				"sgdisk",
+				"tpm2-tools",
+				"tzdata",
+				"util-linux",
+				"xz",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"bash",
+				"blkid",
+				"busybox-openrc",
+				"ca-certificates",
+				"cloud-utils-growpart",
+				"connman",
+				"conntrack-tools",
+				"coreutils",
+				"cryptsetup",
+				"dmidecode",
+				"e2fsprogs-extra",
+				"eudev",
+				"findutils",
+				"haveged",
+				"iproute2",
+				"libc6-compat",
+				"mdadm",
+				"multipath-tools",
+				"nfs-utils",
+				"open-iscsi",
+				"openrc",
+				"openssh-client",
+				"openssh-server",
+				"procps",
+				"sgdisk",
+				"tpm2-tools",
+				"tzdata",
+				"util-linux",
+				"xz",
+			},
+		},
 	},
-	RedHat: {},
-	Fedora: {},
-	Alpine: {},
-	Arch:   {},
-	Debian: {},
 }
 
 // GrubPackages is a map of packages to install for each distro and architecture.
@@ -165,10 +1080,211 @@ var GrubPackages = PackageMap{
 			},
 		},
 	},
+	Debian: {
+		ArchAMD64: {
+			Common: {
+				"grub2",
+				"grub-efi-amd64-bin",
+				"grub-efi-amd64-signed",
+				"grub-pc-bin",
+				"coreutils",
+				"grub2-common",
+				"kbd",
+				"lldpd",
+				"neovim",
+				"shim-signed",
+				"snmpd",
+				"squashfs-tools",
+				// zfsutils-linux lives in contrib on Debian, so its not installed by default
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"grub-efi-arm64",
+				"grub-efi-arm64-bin",
+				"grub-efi-arm64-signed",
+				"shim-signed",
+				"squashfs-tools",
+			},
+		},
+	},
+	Fedora: {
+		ArchAMD64: {
+			Common: {
+				"grub2",
+				"grub2-efi-x64",         // Basic grub support for EFI
+				"grub2-efi-x64-modules", // Grub modules for EFI, needed to build the EFI images
+				"grub2-pc",              // Basic grub support for BIOS
+				"grub2-tools",
+				"efibootmgr",
+				"kbd",
+				"shim-x64", // For secure boot support
+				"squashfs-tools",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"grub2-efi-aa64",
+				"grub2-efi-aa64-modules",
+				"grub2-tools",
+				"efibootmgr",
+				"shim-aa64",
+				"squashfs-tools",
+			},
+		},
+	},
+	RedHat: {
+		ArchAMD64: {
+			">=8": {
+				"grub2-efi-x64",
+				"grub2-efi-x64-modules",
+				"grub2-pc",
+				"grub2-tools",
+				"efibootmgr",
+				"kbd",
+				"shim-x64",
+				"squashfs-tools",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"grub2-efi-aa64",
+				"grub2-efi-aa64-modules",
+				"grub2-tools",
+				"efibootmgr",
+				"shim-aa64",
+				"squashfs-tools",
+			},
+		},
+	},
+	RockyLinux: {
+		ArchAMD64: {
+			">=8": {
+				"grub2-efi-x64",
+				"grub2-efi-x64-modules",
+				"grub2-pc",
+				"grub2-tools",
+				"efibootmgr",
+				"kbd",
+				"shim-x64",
+				"squashfs-tools",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"grub2-efi-aa64",
+				"grub2-efi-aa64-modules",
+				"grub2-tools",
+				"efibootmgr",
+				"shim-aa64",
+				"squashfs-tools",
+			},
+		},
+	},
+	AlmaLinux: {
+		ArchAMD64: {
+			">=8": {
+				"grub2-efi-x64",
+				"grub2-efi-x64-modules",
+				"grub2-pc",
+				"grub2-tools",
+				"efibootmgr",
+				"kbd",
+				"shim-x64",
+				"squashfs-tools",
+			},
+		},
+		ArchARM64: {
+			">=8": {
+				"grub2-efi-aa64",
+				"grub2-efi-aa64-modules",
+				"grub2-tools",
+				"efibootmgr",
+				"shim-aa64",
+				"squashfs-tools",
+			},
+		},
+	},
+	OpenSUSELeap: {
+		ArchAMD64: {
+			Common: {
+				"grub2",
+				"grub2-i386-pc",    // Basic grub support for BIOS
+				"grub2-x86_64-efi", // Basic grub support for EFI
+				"efibootmgr",
+				"kbd",
+				"shim",
+				"squashfs",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"grub2",
+				"grub2-arm64-efi",
+				"efibootmgr",
+				"shim",
+				"squashfs",
+			},
+		},
+	},
+	OpenSUSETumbleweed: {
+		ArchAMD64: {
+			Common: {
+				"grub2",
+				"grub2-i386-pc",
+				"grub2-x86_64-efi",
+				"efibootmgr",
+				"kbd",
+				"shim",
+				"squashfs",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"grub2",
+				"grub2-arm64-efi",
+				"efibootmgr",
+				"shim",
+				"squashfs",
+			},
+		},
+	},
+	Arch: {
+		ArchAMD64: {
+			Common: {
+				"grub",
+				"efibootmgr",
+				"kbd",
+				"squashfs-tools",
+				// No shim on Arch official repos, secure boot is not supported out of the box
+			},
+		},
+	},
+	Alpine: {
+		ArchAMD64: {
+			Common: {
+				"grub",
+				"grub-bios",
+				"grub-efi",
+				"efibootmgr",
+				"kbd-bkeymaps",
+				"squashfs-tools",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"grub",
+				"grub-efi",
+				"efibootmgr",
+				"squashfs-tools",
+			},
+		},
+	},
 }
 
 // SystemdPackages is a map of packages to install for each distro and architecture for systemd-boot (trusted boot) variants
 // TODO: Check why some packages we only install on amd64 and not on arm64?? Like kmod???
+// RHEL and rebuilds do not ship systemd-boot and Alpine has no systemd, so they cant run trusted boot
 var SystemdPackages = PackageMap{
 	Ubuntu: {
 		ArchAMD64: {
@@ -188,6 +1304,82 @@ var SystemdPackages = PackageMap{
 			},
 		},
 	},
+	Debian: {
+		ArchAMD64: {
+			Common: {
+				"systemd",
+				"kmod",
+			},
+			">=12": {
+				"systemd-boot", // Trusted boot support, it was split as a package on bookworm
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"systemd",
+				"kmod",
+			},
+			">=12": {
+				"systemd-boot",
+			},
+		},
+	},
+	Fedora: {
+		ArchAMD64: {
+			Common: {
+				"systemd",
+				"systemd-boot-unsigned",
+				"kmod",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"systemd",
+				"systemd-boot-unsigned",
+				"kmod",
+			},
+		},
+	},
+	OpenSUSELeap: {
+		ArchAMD64: {
+			Common: {
+				"systemd",
+				"systemd-boot",
+				"kmod",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"systemd",
+				"systemd-boot",
+				"kmod",
+			},
+		},
+	},
+	OpenSUSETumbleweed: {
+		ArchAMD64: {
+			Common: {
+				"systemd",
+				"systemd-boot",
+				"kmod",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"systemd",
+				"systemd-boot",
+				"kmod",
+			},
+		},
+	},
+	Arch: {
+		ArchAMD64: {
+			Common: {
+				"systemd", // systemd-boot is part of the systemd package on Arch
+				"kmod",
+			},
+		},
+	},
 }
 
 // PackageListToTemplate takes a list of packages and a map of parameters to replace in the package name
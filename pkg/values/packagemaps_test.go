@@ -0,0 +1,65 @@
+package values
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMissingPackageCategories(t *testing.T) {
+	tests := []struct {
+		name    string
+		distro  Distro
+		arch    Architecture
+		version string
+		mode    BootMode
+		missing []PackageCategory
+	}{
+		{"ubuntu", Ubuntu, ArchAMD64, "24.04", GrubBoot, nil},
+		{"ubuntu trusted boot", Ubuntu, ArchAMD64, "24.04", TrustedBoot, nil},
+		// The kernel packages start on 20.04
+		{"older version", Ubuntu, ArchAMD64, "18.04", GrubBoot, []PackageCategory{KernelCategory}},
+		// Only the Common packages apply when the version cannot be parsed
+		{"unparseable version", Ubuntu, ArchAMD64, "noble", GrubBoot, []PackageCategory{KernelCategory}},
+		{"rocky 8", RockyLinux, ArchAMD64, "8.9", GrubBoot, nil},
+		{"alma 9 arm64", AlmaLinux, ArchARM64, "9.4", GrubBoot, nil},
+		{"constraint not matching", RockyLinux, ArchAMD64, "7.9", GrubBoot, []PackageCategory{BaseCategory, ImmucoreCategory, KernelCategory, GrubCategory}},
+		{"only categories for the boot mode", RockyLinux, ArchAMD64, "7.9", TrustedBoot, []PackageCategory{BaseCategory, KernelCategory, SystemdCategory}},
+		{"arch arm64", Arch, ArchARM64, "", GrubBoot, []PackageCategory{BaseCategory, ImmucoreCategory, KernelCategory, GrubCategory}},
+		{"any version", RockyLinux, ArchAMD64, "", GrubBoot, nil},
+		{"unknown distro", Unknown, ArchAMD64, "1.0", GrubBoot, []PackageCategory{BaseCategory, ImmucoreCategory, KernelCategory, GrubCategory}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing := MissingPackageCategories(tt.distro, tt.arch, tt.version, tt.mode)
+			if !slices.Equal(missing, tt.missing) {
+				t.Errorf("MissingPackageCategories(%s, %s, %q, %s) = %v, want %v", tt.distro, tt.arch, tt.version, tt.mode, missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestPackageOverridesValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		category PackageCategory
+		distro   Distro
+		arch     Architecture
+		valid    bool
+	}{
+		{"category", BaseCategory, Ubuntu, ArchAMD64, true},
+		{"common", CommonCategory, Ubuntu, ArchAMD64, true},
+		{"unknown category", "kernels", Ubuntu, ArchAMD64, false},
+		{"unknown distro", BaseCategory, "ubuntu-core", ArchAMD64, false},
+		{"unknown arch", BaseCategory, Ubuntu, "riscv64", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := PackageOverrides{Remove: map[PackageCategory]PackageMap{
+				tt.category: {tt.distro: {tt.arch: {Common: {"nano"}}}},
+			}}
+			if err := o.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
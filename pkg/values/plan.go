@@ -0,0 +1,93 @@
+package values
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Plan collects everything that would be done to the system when running in dry-run mode.
+// Features record their actions here instead of touching the system, so we can print the
+// full list at the end and review it before building a real image.
+type Plan struct {
+	Features    []string
+	Packages    []string
+	Commands    []string
+	Images      []string
+	Created     []string
+	Removed     []string
+	Workarounds []string
+}
+
+// AddFeature records a feature that would be installed
+func (p *Plan) AddFeature(name string) {
+	p.Features = append(p.Features, name)
+}
+
+// AddPackages records the packages that would be installed
+func (p *Plan) AddPackages(packages ...string) {
+	p.Packages = append(p.Packages, packages...)
+}
+
+// AddCommand records a command that would be run
+func (p *Plan) AddCommand(cmd string, args []string) {
+	p.Commands = append(p.Commands, strings.TrimSpace(cmd+" "+strings.Join(args, " ")))
+}
+
+// AddImage records an image that would be extracted into the given destination
+func (p *Plan) AddImage(image, destination string) {
+	p.Images = append(p.Images, fmt.Sprintf("%s -> %s", image, destination))
+}
+
+// AddCreated records a file that would be created or overwritten.
+// Several features can write to the same file, so it is only recorded once
+func (p *Plan) AddCreated(path string) {
+	if slices.Contains(p.Created, path) {
+		return
+	}
+	p.Created = append(p.Created, path)
+}
+
+// AddRemoved records a file that would be removed
+func (p *Plan) AddRemoved(path string) {
+	p.Removed = append(p.Removed, path)
+}
+
+// AddWorkaround records a workaround that would be applied
+func (p *Plan) AddWorkaround(name string) {
+	p.Workarounds = append(p.Workarounds, name)
+}
+
+// Write prints the plan in a human-readable way
+func (p *Plan) Write(w io.Writer) error {
+	sections := []struct {
+		title string
+		items []string
+	}{
+		{"Features", p.Features},
+		{"Packages", p.Packages},
+		{"Commands", p.Commands},
+		{"Images", p.Images},
+		{"Files created", p.Created},
+		{"Files removed", p.Removed},
+		{"Workarounds", p.Workarounds},
+	}
+	for _, section := range sections {
+		if _, err := fmt.Fprintf(w, "%s:\n", section.title); err != nil {
+			return err
+		}
+		if len(section.items) == 0 {
+			if _, err := fmt.Fprintln(w, "  (none)"); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, item := range section.items {
+			if _, err := fmt.Fprintf(w, "  - %s\n", item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
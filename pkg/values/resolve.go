@@ -0,0 +1,132 @@
+package values
+
+import (
+	"cmp"
+	"fmt"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ResolveFeatures sets the system features to the requested ones plus their dependencies, sorted so every feature
+// is installed after the ones it depends on. See SortFeatures
+func (s *System) ResolveFeatures(registry map[string]Feature, names []string, l sdkTypes.KairosLogger) error {
+	features, err := SortFeatures(registry, names, l)
+	if err != nil {
+		return err
+	}
+	s.Features = features
+	var order []string
+	for _, f := range features {
+		order = append(order, f.Name())
+	}
+	l.Logger.Info().Strs("order", order).Msg("Features will be installed in this order")
+	return nil
+}
+
+// LastFeature is implemented by the features that must run after all the others, like the cleanup
+type LastFeature interface {
+	RunsLast() bool
+}
+
+// runsLast returns true if the feature must run after all the others
+func runsLast(f Feature) bool {
+	last, ok := f.(LastFeature)
+	return ok && last.RunsLast()
+}
+
+// SortFeatures returns the features with the given registry names plus the ones they depend on, sorted so every
+// feature comes after its dependencies. Features with no order between them are sorted by name, so the result is
+// stable, except the ones implementing LastFeature which go after the rest.
+// Unknown features or dependencies and dependency cycles are errors
+func SortFeatures(registry map[string]Feature, names []string, l sdkTypes.KairosLogger) ([]Feature, error) {
+	// Collect the requested features first, so we only report the ones added as dependencies
+	requested := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := registry[name]; !ok {
+			return nil, fmt.Errorf("unknown feature %s", name)
+		}
+		if requested[name] {
+			l.Logger.Debug().Str("feature", name).Msg("Feature requested more than once, ignoring it")
+		}
+		requested[name] = true
+	}
+	var addDependencies func(name string) error
+	addDependencies = func(name string) error {
+		for _, dep := range registry[name].Dependencies() {
+			if _, ok := registry[dep]; !ok {
+				return fmt.Errorf("feature %s depends on unknown feature %s", name, dep)
+			}
+			if requested[dep] {
+				continue
+			}
+			l.Logger.Info().Str("feature", dep).Str("requiredBy", name).Msg("Adding feature dependency")
+			requested[dep] = true
+			if err := addDependencies(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(requested)) {
+		if err := addDependencies(name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Topological sort, picking the first by name from the ones that have all their dependencies sorted
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	for name := range requested {
+		pending[name] = 0
+		for _, dep := range registry[name].Dependencies() {
+			pending[name]++
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+	var ready []string
+	for name, n := range pending {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	var sorted []Feature
+	for len(ready) > 0 {
+		slices.SortFunc(ready, func(a, b string) int {
+			return cmp.Or(
+				cmp.Compare(boolToInt(runsLast(registry[a])), boolToInt(runsLast(registry[b]))),
+				cmp.Compare(a, b),
+			)
+		})
+		name := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, registry[name])
+		for _, dependent := range dependents[name] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(sorted) != len(requested) {
+		var cycle []string
+		for name, n := range pending {
+			if n > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		slices.Sort(cycle)
+		return nil, fmt.Errorf("dependency cycle between features: %s", strings.Join(cycle, ", "))
+	}
+	return sorted, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
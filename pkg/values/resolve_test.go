@@ -0,0 +1,110 @@
+package values
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// fakeFeature is a feature that only has a name and dependencies, for sorting
+type fakeFeature struct {
+	name string
+	deps []string
+	last bool
+}
+
+func (f fakeFeature) Install(System, sdkTypes.KairosLogger) error  { return nil }
+func (f fakeFeature) Remove(System, sdkTypes.KairosLogger) error   { return nil }
+func (f fakeFeature) Info(System, sdkTypes.KairosLogger)           {}
+func (f fakeFeature) Installed(System, sdkTypes.KairosLogger) bool { return false }
+func (f fakeFeature) HasServices() bool                            { return false }
+func (f fakeFeature) InstallsPackages() bool                       { return false }
+func (f fakeFeature) Name() string                                 { return f.name }
+func (f fakeFeature) Dependencies() []string                       { return f.deps }
+func (f fakeFeature) Checks(System, sdkTypes.KairosLogger) []Check { return nil }
+func (f fakeFeature) RunsLast() bool                               { return f.last }
+
+// registry builds a registry from the features, keyed by their name
+func registry(features ...fakeFeature) map[string]Feature {
+	r := map[string]Feature{}
+	for _, f := range features {
+		r[f.name] = f
+	}
+	return r
+}
+
+func TestSortFeatures(t *testing.T) {
+	l := sdkTypes.NewKairosLogger("test", "error", false)
+	chain := registry(
+		fakeFeature{name: "base"},
+		fakeFeature{name: "kernel", deps: []string{"base"}},
+		fakeFeature{name: "initrd", deps: []string{"kernel", "base"}},
+		fakeFeature{name: "release"},
+		fakeFeature{name: "clean", deps: []string{"kernel"}, last: true},
+	)
+	tests := []struct {
+		name     string
+		registry map[string]Feature
+		names    []string
+		want     []string
+		err      string
+	}{
+		{name: "single", registry: chain, names: []string{"release"}, want: []string{"release"}},
+		{name: "adds dependencies", registry: chain, names: []string{"initrd"}, want: []string{"base", "kernel", "initrd"}},
+		{name: "names are case insensitive", registry: chain, names: []string{"Kernel"}, want: []string{"base", "kernel"}},
+		{name: "repeated names", registry: chain, names: []string{"kernel", "kernel"}, want: []string{"base", "kernel"}},
+		{
+			name:     "last feature goes after the rest",
+			registry: chain,
+			names:    []string{"clean", "release", "initrd"},
+			want:     []string{"base", "kernel", "initrd", "release", "clean"},
+		},
+		{name: "unknown feature", registry: chain, names: []string{"nope"}, err: "unknown feature nope"},
+		{
+			name:     "unknown dependency",
+			registry: registry(fakeFeature{name: "a", deps: []string{"missing"}}),
+			names:    []string{"a"},
+			err:      "feature a depends on unknown feature missing",
+		},
+		{
+			name: "cycle",
+			registry: registry(
+				fakeFeature{name: "a", deps: []string{"b"}},
+				fakeFeature{name: "b", deps: []string{"c"}},
+				fakeFeature{name: "c", deps: []string{"a"}},
+				fakeFeature{name: "d"},
+			),
+			names: []string{"a", "d"},
+			err:   "dependency cycle between features: a, b, c",
+		},
+		{
+			name:     "self dependency",
+			registry: registry(fakeFeature{name: "a", deps: []string{"a"}}),
+			names:    []string{"a"},
+			err:      "dependency cycle between features: a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted, err := SortFeatures(tt.registry, tt.names, l)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("SortFeatures() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SortFeatures() unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range sorted {
+				got = append(got, f.Name())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SortFeatures() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package values
+
+import "slices"
+
+// servicesmap is a map of the services to enable, disable or mask for each distro.
+// Services are named differently across distros, like ssh vs sshd, so each distro lists its own.
+//
+// For systemd based distros the names are the unit names.
+// For openrc based distros (Alpine) the names are the init scripts, with an optional runlevel in the
+// "name:runlevel" notation. If no runlevel is given, the default runlevel is used.
+
+// Services lists what to do with the services of a system
+type Services struct {
+	Enable  []string
+	Disable []string
+	Mask    []string
+}
+
+// Merge returns the services with the ones from o appended, skipping duplicates
+func (s Services) Merge(o Services) Services {
+	merge := func(a, b []string) []string {
+		merged := slices.Clone(a)
+		for _, service := range b {
+			if !slices.Contains(merged, service) {
+				merged = append(merged, service)
+			}
+		}
+		return merged
+	}
+	return Services{
+		Enable:  merge(s.Enable, o.Enable),
+		Disable: merge(s.Disable, o.Disable),
+		Mask:    merge(s.Mask, o.Mask),
+	}
+}
+
+// CommonSystemdServices are the services for all the systemd based distros
+var CommonSystemdServices = Services{
+	Mask: []string{
+		"systemd-pcrlock-make-policy.service", // Breaks boot when there is no tpm policy, we manage measured boot ourselves
+	},
+}
+
+// ServicesMap are the services for each distro, on top of the common ones for its init system
+var ServicesMap = map[Distro]Services{
+	Debian: {
+		Enable: []string{"ssh.service", "systemd-networkd.service"},
+	},
+	Ubuntu: {
+		Enable: []string{"ssh.service", "systemd-networkd.service"},
+	},
+	RedHat: {
+		Enable: []string{"sshd.service"},
+	},
+	RockyLinux: {
+		Enable: []string{"sshd.service"},
+	},
+	AlmaLinux: {
+		Enable: []string{"sshd.service"},
+	},
+	Fedora: {
+		Enable: []string{"sshd.service", "systemd-networkd.service"},
+	},
+	Arch: {
+		Enable: []string{"sshd.service", "systemd-networkd.service"},
+	},
+	OpenSUSELeap: {
+		Enable: []string{"sshd.service"},
+	},
+	OpenSUSETumbleweed: {
+		Enable: []string{"sshd.service"},
+	},
+	Alpine: {
+		Enable: []string{
+			"devfs:sysinit",
+			"udev:sysinit",
+			"udev-trigger:sysinit",
+			"hwclock:boot",
+			"syslog:boot",
+			"sshd",
+		},
+	},
+}
+
+// InitSystem is the init system used by a distro
+type InitSystem string
+
+func (i InitSystem) String() string {
+	return string(i)
+}
+
+const (
+	Systemd InitSystem = "systemd"
+	OpenRC  InitSystem = "openrc"
+)
+
+// InitSystem returns the init system of the system
+func (s System) InitSystem() InitSystem {
+	if s.Family == AlpineFamily {
+		return OpenRC
+	}
+	return Systemd
+}
+
+// Services returns the services to enable, disable or mask for the system
+func (s System) Services() Services {
+	services := Services{}
+	if s.InitSystem() == Systemd {
+		services = services.Merge(CommonSystemdServices)
+	}
+	return services.Merge(ServicesMap[s.Distro])
+}
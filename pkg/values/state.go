@@ -0,0 +1,68 @@
+package values
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateFile is where the features that completed successfully are recorded, so an interrupted run can be resumed
+const StateFile = "/etc/kairos/kairos-init.state"
+
+// State is the record of the features that completed successfully on the system
+type State struct {
+	Completed map[string]time.Time `json:"completed"`
+}
+
+// ReadState reads the state of the system. A missing state file returns an empty state
+func ReadState(s System) (*State, error) {
+	st := &State{Completed: map[string]time.Time{}}
+	data, err := os.ReadFile(s.RootPath(StateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err = json.Unmarshal(data, st); err != nil {
+		return st, err
+	}
+	if st.Completed == nil {
+		st.Completed = map[string]time.Time{}
+	}
+	return st, nil
+}
+
+// IsCompleted returns true if the feature completed on a previous run
+func (st *State) IsCompleted(feature string) bool {
+	_, ok := st.Completed[feature]
+	return ok
+}
+
+// MarkCompleted records that the feature completed successfully
+func (st *State) MarkCompleted(feature string) {
+	st.Completed[feature] = time.Now().UTC()
+}
+
+// Reset forgets the feature, so it runs again on the next run
+func (st *State) Reset(feature string) {
+	delete(st.Completed, feature)
+}
+
+// Write stores the state on the system. Nothing is written when running in dry-run mode
+func (st *State) Write(s System) error {
+	if s.DryRun() {
+		return nil
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.RootPath(StateFile)
+	if err = os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
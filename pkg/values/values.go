@@ -1,19 +1,49 @@
 package values
 
 import (
+	"fmt"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"github.com/rs/zerolog"
 	"github.com/sanity-io/litter"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
 )
 
-// BinariesCheck returns the list of expected binaries to be in a kairos system
-func BinariesCheck() []string {
-	return []string{
+// BinariesCheck returns the list of expected binaries to be in a kairos system for the boot mode
+func BinariesCheck(mode BootMode) []string {
+	binaries := []string{
 		"immucore",
 		"kairos-agent",
-		"grub-install|grub2-install", // same binary, different names across OSes
 	}
+	if mode == GrubBoot {
+		binaries = append(binaries, "grub-install|grub2-install") // same binary, different names across OSes
+	}
+	return binaries
+}
+
+// InitrdModulesCheck returns the dracut modules expected in the initrd
+func InitrdModulesCheck() []string {
+	return []string{
+		"immucore",
+		"dmsquash-live", // To boot the livecd
+	}
+}
+
+// InitrdFilesCheck returns the files expected in the initrd for the init system, without the leading slash.
+// Alternatives are separated by | as they land on different paths depending on the OS having a merged /usr or not
+func InitrdFilesCheck(init InitSystem) []string {
+	files := []string{
+		"usr/bin/immucore|bin/immucore",
+		"usr/bin/kairos-agent|bin/kairos-agent",
+	}
+	if init == Systemd {
+		// Hook that runs immucore, there is no unit under openrc
+		files = append(files, "usr/lib/systemd/system/immucore.service|lib/systemd/system/immucore.service|etc/systemd/system/immucore.service")
+	}
+	return files
 }
 
 func FilesToRemove() []string {
@@ -37,6 +67,11 @@ const (
 	ArchARM64 Architecture = "arm64"
 )
 
+// Architectures returns all the supported architectures
+func Architectures() []Architecture {
+	return []Architecture{ArchAMD64, ArchARM64}
+}
+
 type Distro string
 
 func (d Distro) String() string {
@@ -58,12 +93,67 @@ const (
 	OpenSUSETumbleweed Distro = "opensuse-tumbleweed"
 )
 
+// Distros returns all the known distros
+func Distros() []Distro {
+	return []Distro{Debian, Ubuntu, RedHat, RockyLinux, AlmaLinux, Fedora, Arch, Alpine, OpenSUSELeap, OpenSUSETumbleweed}
+}
+
+// ManifestDir is where each feature stores the manifest of what it changed on the system
+const ManifestDir = "/etc/kairos/manifests"
+
+// DefaultFrameworkImage is the framework image installed when none is configured
+const DefaultFrameworkImage = "quay.io/kairos/framework:v2.14.4"
+
+// Variants of a kairos image. Standard images ship a k8s provider, core ones do not
 const (
-	ImmutabilitySentinel = "/etc/kairos/.inmmutability_installed"
-	KernelSentinel       = "/etc/kairos/.kernel_installed"
-	InitrdSentinel       = "/etc/kairos/.initrd_installed"
+	CoreVariant     = "core"
+	StandardVariant = "standard"
 )
 
+// Supported k8s providers for the standard variant
+const (
+	K3sProvider = "k3s"
+	K0sProvider = "k0s"
+)
+
+// K8sProviders returns the supported k8s providers
+func K8sProviders() []string {
+	return []string{K3sProvider, K0sProvider}
+}
+
+// Defaults for the release inputs
+const (
+	DefaultVariant  = CoreVariant
+	DefaultModel    = "generic"
+	DefaultVersion  = "v0.0.0"
+	DefaultRegistry = "quay.io/kairos"
+)
+
+// Release are the user inputs used to generate the kairos-release file
+type Release struct {
+	Variant     string // core or standard
+	Model       string // generic, rpi4, etc. Needed to boot!
+	Version     string // Kairos version, like v3.2.3
+	Registry    string // Registry and org where the image is pushed, like quay.io/kairos
+	K8sProvider string // k3s or k0s, only for the standard variant
+	K8sVersion  string // Version of the k8s provider
+}
+
+// Validate checks that the release inputs are known values
+func (r Release) Validate() error {
+	if r.Variant != "" && r.Variant != CoreVariant && r.Variant != StandardVariant {
+		return fmt.Errorf("unknown variant %s. Known variants: %v", r.Variant, []string{CoreVariant, StandardVariant})
+	}
+	if r.K8sProvider != "" && !slices.Contains(K8sProviders(), r.K8sProvider) {
+		return fmt.Errorf("unknown k8s provider %s. Known providers: %v", r.K8sProvider, K8sProviders())
+	}
+	// Standard images are the ones with a k8s provider
+	if r.Variant == StandardVariant && r.K8sProvider == "" {
+		return fmt.Errorf("the %s variant needs a k8s provider. Known providers: %v", StandardVariant, K8sProviders())
+	}
+	return nil
+}
+
 type Family string
 
 func (f Family) String() string {
@@ -80,6 +170,31 @@ const (
 	SUSEFamily    Family = "suse"
 )
 
+// Families returns all the known families
+func Families() []Family {
+	return []Family{DebianFamily, RedHatFamily, ArchFamily, AlpineFamily, SUSEFamily}
+}
+
+// BootMode is how the system boots
+type BootMode string
+
+func (b BootMode) String() string {
+	return string(b)
+}
+
+const (
+	GrubBoot    BootMode = "grub"    // grub plus a dracut generated initrd with immucore
+	TrustedBoot BootMode = "trusted" // systemd-boot with a signed UKI, no initrd is generated
+)
+
+// BootModes returns all the known boot modes
+func BootModes() []BootMode {
+	return []BootMode{GrubBoot, TrustedBoot}
+}
+
+// MinSystemdVersionTrusted is the minimum systemd version needed to boot as a UKI
+const MinSystemdVersionTrusted = 252
+
 type Feature interface {
 	Install(System, sdkTypes.KairosLogger) error
 	Remove(System, sdkTypes.KairosLogger) error
@@ -90,7 +205,16 @@ type Feature interface {
 	HasServices() bool
 	InstallsPackages() bool
 	Name() string
-	GetOrder() int
+	// Dependencies returns the registry names of the features that must be installed before this one
+	Dependencies() []string
+	// Checks returns the checks that validate the feature is correctly installed on the system
+	Checks(System, sdkTypes.KairosLogger) []Check
+}
+
+// Check is a single validation of a feature. Fn returns nil if the check passes
+type Check struct {
+	Name string
+	Fn   func() error
 }
 
 type Features []Feature
@@ -99,7 +223,6 @@ type Features []Feature
 func (f Features) MarshalZerologObject(e *zerolog.Event) {
 	for _, feature := range f {
 		e.Str("name", feature.Name())
-		e.Int("order", feature.GetOrder())
 	}
 }
 
@@ -114,10 +237,27 @@ func (w Workarounds) MarshalZerologObject(e *zerolog.Event) {
 
 type Workaround func(s *System, l sdkTypes.KairosLogger) error
 
+// Name returns the function name of the workaround, without the package path
+func (w Workaround) Name() string {
+	name := runtime.FuncForPC(reflect.ValueOf(w).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
 // Installer is an interface that defines the methods to install and remove packages
+// The System is passed so the installer can honour the dry-run mode
 type Installer interface {
-	Install(packages []string, l sdkTypes.KairosLogger) error
-	Remove(packages []string, l sdkTypes.KairosLogger) error
+	Install(s System, packages []string, l sdkTypes.KairosLogger) error
+	Remove(s System, packages []string, l sdkTypes.KairosLogger) error
+	// Query returns the installed version of the given packages. Packages that are not installed are not returned
+	Query(s System, packages []string, l sdkTypes.KairosLogger) (map[string]string, error)
+}
+
+// CheckInstaller returns an error if no installer was detected for the system, so packages cannot be handled
+func (s System) CheckInstaller() error {
+	if s.Installer == nil {
+		return fmt.Errorf("unsupported distro %s: no package manager detected, set one with --installer", s.Distro)
+	}
+	return nil
 }
 
 // System Represents a kairos-to-be system
@@ -130,33 +270,141 @@ type System struct {
 	Features    Features
 	Workarounds Workarounds `json:"-,omitempty" yaml:"-,omitempty"`
 	Installer   Installer
-	Force       bool // Force will force the installation of the features without checking the Installed() method
+	Force       bool   // Force will force the installation of the features without checking the Installed() method or the state file
+	Plan        *Plan  // Plan is only set on dry-run mode, features record what they would do in it instead of doing it
+	Root        string // Root is the directory where the system lives, defaults to /. Commands are run chrooted into it
+	// StrictPackages fails the package resolution if any package category has no packages for the system
+	StrictPackages bool
+	// PackageOverrides are the user provided packages to add or remove on top of the package maps
+	PackageOverrides PackageOverrides `json:",omitempty"`
+	// Overrides are the detected values that were overridden by the user, so we know where the values came from
+	Overrides map[string]string `json:",omitempty"`
+	// Release are the user inputs for the release file, the rest of the values are derived from the system
+	Release Release `json:",omitempty"`
+	// KernelVersion pins the kernel to use, as named under /lib/modules. Defaults to the newest installed one
+	KernelVersion string `json:",omitempty"`
+	// BootMode selects the packages and features for grub or trusted boot. Defaults to GrubBoot
+	BootMode BootMode `json:",omitempty"`
+	// K8sSource is where to get the k8s provider from. A local binary, or an image reference or local image like
+	// FrameworkImage. Defaults to the provider image for the release k8s version
+	K8sSource string `json:",omitempty"`
+	// FrameworkImage is the source for the framework files. An image reference by tag or digest, or a local
+	// OCI layout directory, docker save tarball or rootfs tarball. Defaults to DefaultFrameworkImage
+	FrameworkImage string `json:",omitempty"`
+}
+
+// RootPath returns the given absolute path prefixed by the system root
+func (s System) RootPath(path string) string {
+	if s.Root == "" {
+		return path
+	}
+	return filepath.Join(s.Root, path)
+}
+
+// GetFrameworkImage returns the configured framework image or the default one
+func (s System) GetFrameworkImage() string {
+	if s.FrameworkImage == "" {
+		return DefaultFrameworkImage
+	}
+	return s.FrameworkImage
+}
+
+// GetBootMode returns the configured boot mode or the default one
+func (s System) GetBootMode() BootMode {
+	if s.BootMode == "" {
+		return GrubBoot
+	}
+	return s.BootMode
+}
+
+// ValidateBootMode checks that the boot mode is known and can be used on the system
+func (s System) ValidateBootMode() error {
+	if !slices.Contains(BootModes(), s.GetBootMode()) {
+		return fmt.Errorf("unknown boot mode %s. Known boot modes: %v", s.BootMode, BootModes())
+	}
+	if s.GetBootMode() == TrustedBoot && s.InitSystem() != Systemd {
+		return fmt.Errorf("trusted boot needs systemd, %s uses %s", s.Distro, s.InitSystem())
+	}
+	return nil
+}
+
+// Chrooted returns true if the system lives in a different root than the one we are running on
+func (s System) Chrooted() bool {
+	return s.Root != "" && filepath.Clean(s.Root) != "/"
+}
+
+// DryRun returns true if the system is running in dry-run mode
+func (s System) DryRun() bool {
+	return s.Plan != nil
 }
 
 // ApplyFeatures will apply the features to the system
+// Features that are already installed are skipped, so an interrupted run resumes from the feature that failed.
+// Features that completed on a previous run, as recorded on the state file, but are no longer installed, like the
+// Kernel after a newer kernel was installed, run again. Force runs all of them again, and as the features add to the
+// manifests of the previous runs, everything they installed can still be removed
 func (s *System) ApplyFeatures(l sdkTypes.KairosLogger) error {
+	state, err := ReadState(*s)
+	if err != nil {
+		l.Logger.Error().Err(err).Str("state", s.RootPath(StateFile)).Msg("Error reading state file.")
+		return err
+	}
 	for _, f := range s.Features {
-		if f.Installed(*s, l) {
-			l.Logger.Info().Str("feature", f.Name()).Msg("Feature already installed.")
-			continue
-		} else {
-			l.Logger.Info().Str("feature", f.Name()).Msg("Installing feature...")
-			err := f.Install(*s, l)
-			if err != nil {
-				return err
+		if s.Force {
+			l.Logger.Debug().Str("feature", f.Name()).Msg("Forcing feature installation")
+		} else if f.Installed(*s, l) {
+			if state.IsCompleted(f.Name()) {
+				l.Logger.Info().Str("feature", f.Name()).Time("completed", state.Completed[f.Name()]).Msg("Feature completed on a previous run.")
+			} else {
+				l.Logger.Info().Str("feature", f.Name()).Msg("Feature already installed.")
 			}
+			continue
+		} else if state.IsCompleted(f.Name()) {
+			l.Logger.Info().Str("feature", f.Name()).Time("completed", state.Completed[f.Name()]).Msg("Feature completed on a previous run but no longer installed, installing it again.")
+		}
+		l.Logger.Info().Str("feature", f.Name()).Msg("Installing feature...")
+		if s.DryRun() {
+			s.Plan.AddFeature(f.Name())
+		}
+		err = f.Install(*s, l)
+		if err != nil {
+			return err
+		}
+		// Only record the features that did something. The ones that had nothing to do, like Kubernetes without a
+		// provider, or that need to run every time, like Cleanup, are not installed after running
+		if !f.Installed(*s, l) {
+			l.Logger.Debug().Str("feature", f.Name()).Msg("Feature not recorded as completed, it will run again on the next run")
+			continue
+		}
+		state.MarkCompleted(f.Name())
+		if err = state.Write(*s); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 // RemoveFeatures will remove the features from the system
+// Features are removed in reverse order, so the ones that depend on others are removed first
 func (s *System) RemoveFeatures(l sdkTypes.KairosLogger) error {
-	for _, f := range s.Features {
-		err := f.Remove(*s, l)
+	state, err := ReadState(*s)
+	if err != nil {
+		return err
+	}
+	for i := len(s.Features) - 1; i >= 0; i-- {
+		f := s.Features[i]
+		l.Logger.Info().Str("feature", f.Name()).Msg("Removing feature...")
+		if s.DryRun() {
+			s.Plan.AddFeature(f.Name())
+		}
+		err = f.Remove(*s, l)
 		if err != nil {
 			return err
 		}
+		state.Reset(f.Name())
+		if err = state.Write(*s); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -167,6 +415,10 @@ func (s *System) ApplyWorkarounds(l sdkTypes.KairosLogger) error {
 		l.Logger.Info().Str("version", s.Version).Str("distro", s.Distro.String()).Str("arch", s.Arch.String()).Msg("Applying workarounds")
 	}
 	for _, w := range s.Workarounds {
+		if s.DryRun() {
+			s.Plan.AddWorkaround(w.Name())
+			continue
+		}
 		err := w(s, l)
 		if err != nil {
 			return err
@@ -209,10 +461,17 @@ func (s *System) GetTemplateParams() map[string]string {
 
 func (s System) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("name", s.Name).
+		Str("root", s.Root).
 		Str("distro", s.Distro.String()).
 		Str("family", s.Family.String()).
 		Str("version", s.Version).
-		Str("arch", s.Arch.String())
+		Str("arch", s.Arch.String()).
+		Str("boot", s.GetBootMode().String()).
+		Str("framework", s.GetFrameworkImage())
+
+	if len(s.Overrides) > 0 {
+		e.Interface("overrides", s.Overrides)
+	}
 
 	e.Object("features", s.Features)
 	e.Object("workarounds", s.Workarounds)